@@ -3,6 +3,8 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -15,9 +17,27 @@ import (
 	"github.com/getsentry/sentry-go"
 )
 
+// Scopes requested during bootstrap
+const (
+	ScopeConfig = "edl_config"
+	ScopeLogs   = "edl_logs"
+)
+
+// componentVersion is reported to the platform during bootstrap
+var componentVersion = "dev"
+
+// SetComponentVersion sets the version reported during bootstrap from the
+// main package
+func SetComponentVersion(v string) {
+	if v != "" {
+		componentVersion = v
+	}
+}
+
 type BootstrapClient struct {
 	httpClient *http.Client
 	apiURL     string
+	scopes     []string
 }
 
 type BootstrapRequest struct {
@@ -34,6 +54,9 @@ type BootstrapResponse struct {
 	JWKSUrl     string `json:"jwks_url"`
 	ConfigURL   string `json:"config_url"`
 	LogsURL     string `json:"logs_url"`
+	// Scopes granted by the platform. Older platforms omit it, in which
+	// case all requested scopes are considered granted.
+	Scopes []string `json:"scopes,omitempty"`
 }
 
 type BootstrapClaims struct {
@@ -43,14 +66,22 @@ type BootstrapClaims struct {
 	ComponentType string `json:"component_type"`
 }
 
-func NewBootstrapClient() *BootstrapClient {
+func NewBootstrapClient(scopes []string) *BootstrapClient {
 	return &BootstrapClient{
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		scopes: scopes,
 	}
 }
 
+// TokenFingerprint returns a short, non-reversible identifier for a token
+// that is safe to log
+func TokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
 func (c *BootstrapClient) parseBootstrapToken(token string) (string, string, string, error) {
 	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
 
@@ -93,9 +124,9 @@ func (c *BootstrapClient) Bootstrap(ctx context.Context, bootstrapToken string)
 	req := BootstrapRequest{
 		BootstrapToken:   bootstrapToken,
 		ComponentType:    componentType,
-		ComponentVersion: "1.0.0", // TODO: make this configurable
+		ComponentVersion: componentVersion,
 		MachineID:        machineID,
-		Scopes:           []string{"edl_config", "edl_logs"}, // Request both config and logs access
+		Scopes:           c.scopes,
 	}
 
 	body, err := json.Marshal(req)
@@ -129,7 +160,15 @@ func (c *BootstrapClient) Bootstrap(ctx context.Context, bootstrapToken string)
 			return nil, err
 		}
 
-		// Other errors (including 403) are temporary
+		// 401/403 means the bootstrap token was revoked
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, &RevokedError{
+				StatusCode: resp.StatusCode,
+				Message:    string(bodyBytes),
+			}
+		}
+
+		// Other errors are temporary
 		err := errors.New("bootstrap failed: " + string(bodyBytes))
 		if resp.StatusCode >= 500 {
 			sentry.CaptureException(err)
@@ -142,6 +181,10 @@ func (c *BootstrapClient) Bootstrap(ctx context.Context, bootstrapToken string)
 		return nil, errors.New("failed to decode bootstrap response: " + err.Error())
 	}
 
+	if bootstrapResp.Scopes == nil {
+		bootstrapResp.Scopes = c.scopes
+	}
+
 	// Store the API URL for future use
 	c.apiURL = issuer
 
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBootstrapSendsVersionAndScopes(t *testing.T) {
+	old := componentVersion
+	SetComponentVersion("1.2.3")
+	defer func() { componentVersion = old }()
+
+	p := newTestPlatform(t)
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig})
+	if err := tm.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := p.request()
+	if req.ComponentVersion != "1.2.3" {
+		t.Errorf("component version = %q, want 1.2.3", req.ComponentVersion)
+	}
+	// Log shipping is off, so its scope is not requested
+	if !slices.Equal(req.Scopes, []string{ScopeConfig}) {
+		t.Errorf("requested scopes = %v, want [%s]", req.Scopes, ScopeConfig)
+	}
+}
+
+func TestGrantedScopesHonored(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted []string
+		logs    bool
+	}{
+		// Platforms that omit the granted scopes grant what was requested
+		{"omitted", nil, true},
+		{"all granted", []string{ScopeConfig, ScopeLogs}, true},
+		{"logs denied", []string{ScopeConfig}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlatform(t)
+			p.logsURL = p.server.URL + "/logs"
+			p.grantedScopes = tt.granted
+
+			tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig, ScopeLogs})
+			if err := tm.refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tm.HasScope(ScopeLogs); got != tt.logs {
+				t.Errorf("HasScope(%s) = %v, want %v", ScopeLogs, got, tt.logs)
+			}
+			// Without the scope, the logs URL is withheld so shipping stays off
+			if got := tm.GetLogsURL() != ""; got != tt.logs {
+				t.Errorf("logs URL = %q, want one: %v", tm.GetLogsURL(), tt.logs)
+			}
+			if !tm.HasScope(ScopeConfig) {
+				t.Errorf("HasScope(%s) = false", ScopeConfig)
+			}
+		})
+	}
+}
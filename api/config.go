@@ -30,6 +30,8 @@ type EDLURLs struct {
 	IPv6          []string `json:"ipv6"`
 	Checksums     []string `json:"checksums"`
 	Unprocessable []string `json:"unprocessable"`
+	Delta         []string `json:"delta,omitempty"`
+	Events        []string `json:"events,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -46,7 +48,18 @@ func NewConfigClient(tokenManager *TokenManager) *ConfigClient {
 	}
 }
 
+// GetEDLConfig reads the EDL configuration from the platform and persists
+// it with the token cache
 func (c *ConfigClient) GetEDLConfig(ctx context.Context) (*EDLConfig, error) {
+	config, err := c.fetchEDLConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.tokenManager.SaveEDLConfig(config)
+	return config, nil
+}
+
+func (c *ConfigClient) fetchEDLConfig(ctx context.Context) (*EDLConfig, error) {
 	configURL := c.tokenManager.GetConfigURL()
 	if configURL == "" {
 		return nil, errors.New("config URL not available")
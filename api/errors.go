@@ -1,5 +1,7 @@
 package api
 
+import "errors"
+
 // PermanentError indicates an unrecoverable error that should not be retried
 type PermanentError struct {
 	StatusCode int
@@ -12,6 +14,24 @@ func (e *PermanentError) Error() string {
 
 // IsPermanentError checks if an error is a permanent error
 func IsPermanentError(err error) bool {
-	_, ok := err.(*PermanentError)
-	return ok
+	var permanentErr *PermanentError
+	return errors.As(err, &permanentErr)
+}
+
+// RevokedError indicates the platform rejected the bootstrap token itself
+// (401/403). It is retried, but will not recover until the token is
+// re-enabled or rotated.
+type RevokedError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RevokedError) Error() string {
+	return "bootstrap token revoked: " + e.Message
+}
+
+// IsRevokedError checks if an error is a revoked token error
+func IsRevokedError(err error) bool {
+	var revokedErr *RevokedError
+	return errors.As(err, &revokedErr)
 }
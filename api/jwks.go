@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksTTL is how long fetched keys are used before being refreshed
+	jwksTTL = 1 * time.Hour
+	// jwksMinRefreshInterval limits refetches triggered by unknown key IDs,
+	// so tokens with bogus kids cannot make us hammer the JWKS endpoint
+	jwksMinRefreshInterval = 30 * time.Second
+	// minRSAKeyBits is the smallest RSA modulus accepted for signing keys
+	minRSAKeyBits = 2048
+)
+
+// signingMethods are the algorithms accepted for platform tokens.
+// Symmetric algorithms and "none" are never accepted.
+var signingMethods = []string{
+	"EdDSA",
+	"ES256", "ES384", "ES512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+}
+
+// JWKSCache fetches and caches the platform's JSON Web Key Set
+type JWKSCache struct {
+	httpClient *http.Client
+	url        string
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func NewJWKSCache(url string) *JWKSCache {
+	return &JWKSCache{
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		url: url,
+	}
+}
+
+// URL returns the JWKS endpoint this cache reads from
+func (c *JWKSCache) URL() string {
+	return c.url
+}
+
+// Keyfunc resolves the verification key for a token by its kid header.
+// An unknown kid triggers a refetch, so rotated keys are picked up.
+func (c *JWKSCache) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys == nil || time.Since(c.fetchedAt) > jwksTTL {
+		if err := c.refresh(ctx); err != nil && c.keys == nil {
+			return nil, err
+		}
+	}
+
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+
+	if time.Since(c.fetchedAt) < jwksMinRefreshInterval {
+		return nil, errors.New("unknown signing key: " + kid)
+	}
+
+	logger.Debug("Signing key not in JWKS, refetching", "kid", kid)
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown signing key: " + kid)
+}
+
+// lookup finds a key by kid. Tokens without a kid are only accepted when
+// the set holds a single key. Callers must hold c.mu.
+func (c *JWKSCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" {
+		if len(c.keys) == 1 {
+			for _, key := range c.keys {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the key set. Callers must hold c.mu.
+func (c *JWKSCache) refresh(ctx context.Context) error {
+	// Record the attempt even if it fails, to honor the refetch limit
+	c.fetchedAt = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return errors.New("failed to create JWKS request: " + err.Error())
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.New("JWKS request failed: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New("JWKS request failed: " + string(body))
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return errors.New("failed to decode JWKS: " + err.Error())
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logger.Debug("Skipping unsupported JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return errors.New("JWKS contains no usable signing keys")
+	}
+
+	c.keys = keys
+	logger.Debug("JWKS refreshed", "keys", len(keys))
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("unsupported OKP curve: " + k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported EC curve: " + k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on curve")
+		}
+		return key, nil
+
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, errors.New("RSA key smaller than " + strconv.Itoa(minRSAKeyBits) + " bits")
+		}
+		return key, nil
+
+	default:
+		return nil, errors.New("unsupported key type: " + k.Kty)
+	}
+}
+
+// checkJWKSURL ensures the JWKS is served over TLS from the issuer's host,
+// so a tampered bootstrap response cannot point us at a rogue key set
+func checkJWKSURL(jwksURL, issuer string) error {
+	return checkPlatformURL("jwks_url", jwksURL, issuer)
+}
+
+// checkPlatformURL ensures a URL from the bootstrap response named field
+// is served over TLS from the issuer's host. The response itself is not
+// signed, so every endpoint it names is checked before it is used.
+func checkPlatformURL(field, rawURL, issuer string) error {
+	if rawURL == "" {
+		return errors.New("bootstrap response missing " + field)
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.New("invalid " + field + ": " + err.Error())
+	}
+	issuerParsed, err := url.Parse(issuer)
+	if err != nil {
+		return errors.New("invalid issuer: " + err.Error())
+	}
+
+	if !strings.EqualFold(parsed.Host, issuerParsed.Host) {
+		return errors.New(field + " host " + parsed.Host + " does not match issuer host " + issuerParsed.Host)
+	}
+	// Plain HTTP is only accepted when the issuer itself uses it
+	if parsed.Scheme != "https" && parsed.Scheme != issuerParsed.Scheme {
+		return errors.New(field + " must use https")
+	}
+
+	return nil
+}
+
+// verifyToken checks the signature of a platform token against the JWKS and
+// that it was issued by issuer. Expiry is always checked when present and
+// required when requireExpiry is set.
+func verifyToken(jwks *JWKSCache, kind, token, issuer string, requireExpiry bool) error {
+	opts := []jwt.ParserOption{jwt.WithValidMethods(signingMethods)}
+	if requireExpiry {
+		opts = append(opts, jwt.WithExpirationRequired())
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, jwks.Keyfunc, opts...); err != nil {
+		metrics.TokenVerificationFailuresTotal.WithLabelValues(kind).Inc()
+		return errors.New(kind + " token verification failed: " + err.Error())
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		metrics.TokenVerificationFailuresTotal.WithLabelValues(kind).Inc()
+		return errors.New(kind + " token has unexpected issuer: " + claims.Issuer)
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRSAKeyMinimumSize(t *testing.T) {
+	for _, bits := range []int{1024, 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := jwk{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+
+		_, err = k.publicKey()
+		if accepted := err == nil; accepted != (bits >= minRSAKeyBits) {
+			t.Errorf("%d bit key accepted = %v", bits, accepted)
+		}
+	}
+}
+
+func TestCheckJWKSURL(t *testing.T) {
+	tests := []struct {
+		jwksURL string
+		issuer  string
+		ok      bool
+	}{
+		{"https://platform.example.com/.well-known/jwks.json", "https://platform.example.com", true},
+		{"https://evil.example.com/jwks.json", "https://platform.example.com", false},
+		{"http://platform.example.com/jwks.json", "https://platform.example.com", false},
+		{"http://localhost:8000/jwks.json", "http://localhost:8000", true},
+		{"", "https://platform.example.com", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkJWKSURL(tt.jwksURL, tt.issuer); (err == nil) != tt.ok {
+			t.Errorf("checkJWKSURL(%q, %q) error = %v, want ok = %v", tt.jwksURL, tt.issuer, err, tt.ok)
+		}
+	}
+}
+
+// testPlatform stands in for the platform's bootstrap and JWKS endpoints
+type testPlatform struct {
+	server *httptest.Server
+	key    ed25519.PrivateKey
+	jwks   []byte
+	hits   atomic.Int32
+	// bootstrapHits counts bootstrap requests, which take bootstrapDelay
+	bootstrapHits  atomic.Int32
+	bootstrapDelay time.Duration
+	// configURL and logsURL replace the URLs in bootstrap responses when set
+	configURL string
+	logsURL   string
+	// grantedScopes is returned as the granted scopes when set
+	grantedScopes []string
+
+	mu sync.Mutex
+	// revoked bootstrap tokens are answered with 401
+	revoked map[string]bool
+	// lastRequest is the last bootstrap request received
+	lastRequest BootstrapRequest
+}
+
+func (p *testPlatform) revoke(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.revoked == nil {
+		p.revoked = map[string]bool{}
+	}
+	p.revoked[token] = true
+}
+
+// record stores the bootstrap request and reports whether its token was
+// revoked
+func (p *testPlatform) record(r *http.Request) bool {
+	var req BootstrapRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastRequest = req
+	return p.revoked[req.BootstrapToken]
+}
+
+func (p *testPlatform) request() BootstrapRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastRequest
+}
+
+func newTestPlatform(t *testing.T) *testPlatform {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPlatform{key: priv}
+	p.jwks, _ = json.Marshal(jwkSet{Keys: []jwk{{
+		Kid: "test",
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(pub),
+	}}})
+
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.hits.Add(1)
+		switch r.URL.Path {
+		case "/jwks.json":
+			_, _ = w.Write(p.jwks)
+		case "/api/v1/edl/bootstrap":
+			p.bootstrapHits.Add(1)
+			time.Sleep(p.bootstrapDelay)
+			if p.record(r) {
+				http.Error(w, "revoked", http.StatusUnauthorized)
+				return
+			}
+			resp := BootstrapResponse{
+				AccessToken: p.sign(t, p.server.URL, time.Hour),
+				ExpiresIn:   3600,
+				JWKSUrl:     p.server.URL + "/jwks.json",
+				ConfigURL:   p.server.URL + "/config",
+				LogsURL:     p.logsURL,
+				Scopes:      p.grantedScopes,
+			}
+			if p.configURL != "" {
+				resp.ConfigURL = p.configURL
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testPlatform) sign(t *testing.T, issuer string, ttl time.Duration) string {
+	t.Helper()
+
+	claims := BootstrapClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+		DeploymentID:  "deployment",
+		ComponentType: "forward_auth",
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestBootstrapVerifiesAgainstIssuerJWKS(t *testing.T) {
+	p := newTestPlatform(t)
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig})
+
+	if _, err := tm.bootstrap(context.Background(), tm.BootstrapToken()); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+}
+
+func TestPinnedIssuerRejectsOtherIssuer(t *testing.T) {
+	p := newTestPlatform(t)
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig})
+	tm.PinPlatform("https://platform.example.com", "")
+
+	_, err := tm.bootstrap(context.Background(), tm.BootstrapToken())
+	if err == nil || !strings.Contains(err.Error(), "pinned issuer") {
+		t.Fatalf("bootstrap error = %v, want pinned issuer mismatch", err)
+	}
+	if hits := p.hits.Load(); hits != 0 {
+		t.Errorf("platform received %d requests, want none", hits)
+	}
+}
+
+func TestPinnedJWKSRejectsOtherKeys(t *testing.T) {
+	p := newTestPlatform(t)
+	pinned := newTestPlatform(t)
+
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig})
+	tm.PinPlatform(p.server.URL, pinned.server.URL+"/jwks.json")
+
+	if _, err := tm.bootstrap(context.Background(), tm.BootstrapToken()); err == nil {
+		t.Fatal("bootstrap succeeded with tokens not signed by the pinned JWKS")
+	}
+	if hits := pinned.hits.Load(); hits == 0 {
+		t.Error("pinned JWKS was not fetched")
+	}
+}
+
+func TestBootstrapRejectsForeignPlatformURLs(t *testing.T) {
+	tests := []struct {
+		name      string
+		configURL string
+		logsURL   string
+	}{
+		{name: "config_url", configURL: "https://rogue.example.com/config"},
+		{name: "logs_url", logsURL: "https://rogue.example.com/logs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlatform(t)
+			p.configURL = tt.configURL
+			p.logsURL = tt.logsURL
+			tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig, ScopeLogs})
+
+			if _, err := tm.bootstrap(context.Background(), tm.BootstrapToken()); err == nil {
+				t.Fatal("bootstrap accepted a response pointing at another host")
+			}
+			if url := tm.GetConfigURL(); url != "" {
+				t.Errorf("config URL %q stored from rejected response", url)
+			}
+		})
+	}
+
+	p := newTestPlatform(t)
+	p.logsURL = p.server.URL + "/logs"
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig, ScopeLogs})
+	if _, err := tm.bootstrap(context.Background(), tm.BootstrapToken()); err != nil {
+		t.Fatalf("bootstrap with platform URLs on the issuer host failed: %v", err)
+	}
+}
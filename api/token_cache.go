@@ -0,0 +1,136 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/keygen-sh/machineid"
+)
+
+// minCachedTokenValidity is the remaining lifetime a persisted token needs
+// to be reused at startup
+const minCachedTokenValidity = 1 * time.Minute
+
+// tokenCache persists the access token and the last EDL configuration
+// across restarts, encrypted with AES-GCM under a key derived from the
+// machine ID and the bootstrap token. The file is therefore only readable
+// on the machine that wrote it and by whoever already holds that secret.
+type tokenCache struct {
+	path string
+}
+
+type cachedToken struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	ConfigURL   string    `json:"config_url"`
+	LogsURL     string    `json:"logs_url"`
+	Scopes      []string  `json:"scopes"`
+	// Last EDL configuration read with this token, if any
+	EDLConfig *EDLConfig `json:"edl_config,omitempty"`
+	// Fingerprint of the bootstrap token the access token was issued for
+	BootstrapFingerprint string `json:"bootstrap_fingerprint"`
+}
+
+func (c *tokenCache) aead(bootstrapToken string) (cipher.AEAD, error) {
+	// ProtectedID is an HMAC keyed with the raw machine ID, which never
+	// leaves the host. The device ID sent to the platform is a ProtectedID
+	// of the deployment ID and reveals neither.
+	machineKey, err := machineid.ProtectedID("ellio-token-cache:" + bootstrapToken)
+	if err != nil {
+		return nil, errors.New("failed to get machine ID: " + err.Error())
+	}
+
+	key := sha256.Sum256([]byte(machineKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load returns the persisted token if it was issued for bootstrapToken and
+// is still valid
+func (c *tokenCache) load(bootstrapToken string) (*cachedToken, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.aead(bootstrapToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("token cache is truncated")
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("token cache cannot be decrypted")
+	}
+
+	var cached cachedToken
+	if err := json.Unmarshal(plaintext, &cached); err != nil {
+		return nil, errors.New("failed to decode token cache: " + err.Error())
+	}
+
+	if cached.BootstrapFingerprint != TokenFingerprint(bootstrapToken) {
+		return nil, errors.New("token cache belongs to a different bootstrap token")
+	}
+	if time.Until(cached.ExpiresAt) < minCachedTokenValidity {
+		return nil, errors.New("cached token has expired")
+	}
+
+	return &cached, nil
+}
+
+// save writes the token atomically, readable by the owner only
+func (c *tokenCache) save(bootstrapToken string, token *cachedToken) error {
+	aead, err := c.aead(bootstrapToken)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := aead.Seal(nonce, nonce, plaintext, nil)
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".token-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
+
+func (c *tokenCache) clear() {
+	_ = os.Remove(c.path)
+}
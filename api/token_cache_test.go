@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keygen-sh/machineid"
+)
+
+func TestTokenCacheRoundTrip(t *testing.T) {
+	p := newTestPlatform(t)
+	bootstrapToken := p.sign(t, p.server.URL, time.Hour)
+	cache := &tokenCache{path: filepath.Join(t.TempDir(), "token.cache")}
+
+	token := &cachedToken{
+		AccessToken:          "access-token",
+		ExpiresAt:            time.Now().Add(time.Hour),
+		ConfigURL:            "https://platform.example.com/config",
+		EDLConfig:            &EDLConfig{Purpose: "blocklist", Enabled: true},
+		BootstrapFingerprint: TokenFingerprint(bootstrapToken),
+	}
+	if err := cache.save(bootstrapToken, token); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(cache.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("cache file mode = %o, want 600", mode)
+	}
+	data, _ := os.ReadFile(cache.path)
+	if bytes.Contains(data, []byte("access-token")) {
+		t.Error("cache file contains the plaintext token")
+	}
+
+	loaded, err := cache.load(bootstrapToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AccessToken != token.AccessToken || loaded.EDLConfig == nil || loaded.EDLConfig.Purpose != "blocklist" {
+		t.Errorf("loaded = %+v", loaded)
+	}
+
+	// The key also depends on the bootstrap token, so another token of the
+	// same deployment on the same machine cannot read it
+	if _, err := cache.load(p.sign(t, p.server.URL, 2*time.Hour)); err == nil {
+		t.Error("cache decrypted with a different bootstrap token")
+	}
+}
+
+func TestTokenCacheKeyNotDerivedFromDeviceID(t *testing.T) {
+	p := newTestPlatform(t)
+	bootstrapToken := p.sign(t, p.server.URL, time.Hour)
+	cache := &tokenCache{path: filepath.Join(t.TempDir(), "token.cache")}
+
+	if err := cache.save(bootstrapToken, &cachedToken{AccessToken: "access-token"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(cache.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The device ID is shipped with every access event
+	_, _, deploymentID, err := (&BootstrapClient{}).parseBootstrapToken(bootstrapToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceID, err := machineid.ProtectedID(deploymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{deviceID, "ellio-token-cache:" + deviceID} {
+		key := sha256.Sum256([]byte(secret))
+		block, _ := aes.NewCipher(key[:])
+		aead, _ := cipher.NewGCM(block)
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if _, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			t.Errorf("cache decrypted with a key derived from the device ID")
+		}
+	}
+}
+
+func TestCachedTokenRestoresEDLConfig(t *testing.T) {
+	p := newTestPlatform(t)
+	bootstrapToken := p.sign(t, p.server.URL, time.Hour)
+	path := filepath.Join(t.TempDir(), "token.cache")
+
+	tm := NewTokenManager(bootstrapToken, []string{ScopeConfig})
+	tm.EnableCache(path)
+	tm.store(&BootstrapResponse{AccessToken: "access-token", ExpiresIn: 3600, ConfigURL: p.server.URL + "/config"})
+	tm.SaveEDLConfig(&EDLConfig{Purpose: "allowlist", Enabled: true})
+
+	// The platform is unreachable after the restart
+	p.server.Close()
+
+	restarted := NewTokenManager(bootstrapToken, []string{ScopeConfig})
+	restarted.EnableCache(path)
+	if !restarted.loadCached() {
+		t.Fatal("cached token not used")
+	}
+	if got := restarted.GetToken(); got != "access-token" {
+		t.Errorf("GetToken() = %q", got)
+	}
+	if cfg := restarted.CachedEDLConfig(); cfg == nil || cfg.Purpose != "allowlist" {
+		t.Errorf("CachedEDLConfig() = %+v", cfg)
+	}
+}
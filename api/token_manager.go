@@ -3,11 +3,30 @@ package api
 import (
 	"context"
 	"errors"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
 	"github.com/getsentry/sentry-go"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// Failed refreshes are retried with exponential backoff between these
+	// bounds, spread by refreshJitter
+	refreshRetryDelay    = 30 * time.Second
+	maxRefreshRetryDelay = 10 * time.Minute
+	refreshJitter        = 0.2
+
+	// refreshTimeout bounds a shared refresh, which runs detached from the
+	// contexts of its callers
+	refreshTimeout = 30 * time.Second
 )
 
 type TokenManager struct {
@@ -19,41 +38,83 @@ type TokenManager struct {
 	tokenExpiry       time.Time
 	configURL         string
 	logsURL           string
+	scopes            []string
 	deploymentDeleted bool
+	tokenRevoked      bool
+	lastRefreshError  error
+	jwks              *JWKSCache
+	cache             *tokenCache
+	edlConfig         *EDLConfig
+
+	// Optional trust anchors, see PinPlatform
+	pinnedIssuer  string
+	pinnedJWKSURL string
 
 	refreshInterval time.Duration
 	stopCh          chan struct{}
+	refreshGroup    singleflight.Group
+	// bootstrapMu serializes refreshes with bootstrap token rotation, so
+	// only one bootstrap request is in flight at a time
+	bootstrapMu sync.Mutex
+
+	// Refresh loop state, so the loop can be resumed after a deleted
+	// deployment is restored
+	loopCtx     context.Context
+	loopRunning bool
 }
 
-func NewTokenManager(bootstrapToken string) *TokenManager {
+// NewTokenManager creates a token manager requesting the given scopes
+func NewTokenManager(bootstrapToken string, scopes []string) *TokenManager {
 	return &TokenManager{
-		bootstrapClient: NewBootstrapClient(),
+		bootstrapClient: NewBootstrapClient(scopes),
 		bootstrapToken:  bootstrapToken,
 		refreshInterval: 5 * time.Minute,
 		stopCh:          make(chan struct{}),
 	}
 }
 
+// EnableCache persists the access token at path, so a restart can reuse it
+// instead of depending on the platform being reachable. Call before
+// Initialize.
+func (tm *TokenManager) EnableCache(path string) {
+	tm.cache = &tokenCache{path: path}
+}
+
+// PinPlatform only accepts bootstrap tokens issued by issuer and verifies
+// tokens against the JWKS at jwksURL instead of the one named in bootstrap
+// responses. Without pins, the issuer is taken from the bootstrap token
+// and its JWKS is trusted on first use. Either may be empty. Call before
+// Initialize.
+func (tm *TokenManager) PinPlatform(issuer, jwksURL string) {
+	tm.pinnedIssuer = issuer
+	tm.pinnedJWKSURL = jwksURL
+}
+
 func (tm *TokenManager) Initialize(ctx context.Context) error {
+	logger.Debug("Using bootstrap token", "fingerprint", TokenFingerprint(tm.BootstrapToken()))
+
+	if tm.loadCached() {
+		return nil
+	}
+
 	// Perform initial bootstrap
-	resp, err := tm.bootstrapClient.Bootstrap(ctx, tm.bootstrapToken)
+	start := time.Now()
+	resp, err := tm.bootstrap(ctx, tm.BootstrapToken())
+	tm.recordRefresh(start, err)
 	if err != nil {
 		// Check if it's a permanent error (410)
 		if IsPermanentError(err) {
 			tm.mu.Lock()
 			tm.deploymentDeleted = true
 			tm.mu.Unlock()
+			tm.clearCache()
 			logger.Warn("Deployment has been permanently deleted (410). Switching to allow-all mode")
+			return err
 		}
 		return errors.New("initial bootstrap failed: " + err.Error())
 	}
 
-	tm.mu.Lock()
-	tm.currentToken = resp.AccessToken
-	tm.tokenExpiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
-	tm.configURL = resp.ConfigURL
-	tm.logsURL = resp.LogsURL
-	tm.mu.Unlock()
+	tm.store(resp)
 
 	logger.Info("Bootstrap successful",
 		"expires_in", resp.ExpiresIn,
@@ -63,20 +124,35 @@ func (tm *TokenManager) Initialize(ctx context.Context) error {
 }
 
 func (tm *TokenManager) StartRefreshLoop(ctx context.Context) {
+	tm.mu.Lock()
+	tm.loopCtx = ctx
+	// Don't start refresh loop if deployment is already deleted; Probe
+	// starts it once the deployment is restored
+	if tm.deploymentDeleted {
+		tm.mu.Unlock()
+		logger.Debug("Not starting token refresh loop - deployment is deleted")
+		return
+	}
+	if tm.loopRunning {
+		tm.mu.Unlock()
+		return
+	}
+	tm.loopRunning = true
+	tm.mu.Unlock()
+
 	go func() {
-		// Don't start refresh loop if deployment is already deleted
-		tm.mu.RLock()
-		if tm.deploymentDeleted {
-			tm.mu.RUnlock()
-			logger.Debug("Not starting token refresh loop - deployment is deleted")
-			return
-		}
-		tm.mu.RUnlock()
+		defer func() {
+			tm.mu.Lock()
+			tm.loopRunning = false
+			tm.mu.Unlock()
+		}()
 
 		// Calculate when to refresh (80% of token lifetime)
 		refreshTimer := time.NewTimer(tm.calculateRefreshInterval())
 		defer refreshTimer.Stop()
 
+		failures := 0
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -95,11 +171,15 @@ func (tm *TokenManager) StartRefreshLoop(ctx context.Context) {
 				}
 
 				if err := tm.refresh(ctx); err != nil {
-					logger.Error("Token refresh failed", "error", err)
-					sentry.CaptureException(err)
-					// Retry after a short delay
-					refreshTimer.Reset(30 * time.Second)
+					failures++
+					delay := utils.Jitter(utils.Backoff(refreshRetryDelay, maxRefreshRetryDelay, failures-1), refreshJitter)
+					logger.Error("Token refresh failed", "error", err, "retry_in", delay)
+					if !IsRevokedError(err) {
+						sentry.CaptureException(err)
+					}
+					refreshTimer.Reset(delay)
 				} else {
+					failures = 0
 					refreshTimer.Reset(tm.calculateRefreshInterval())
 				}
 			}
@@ -124,33 +204,355 @@ func (tm *TokenManager) calculateRefreshInterval() time.Duration {
 	return refreshAt
 }
 
+// refresh re-bootstraps with the current bootstrap token. Concurrent
+// callers, e.g. the refresh loop and GetTokenWithMinValidity, share a
+// single in-flight request.
 func (tm *TokenManager) refresh(ctx context.Context) error {
-	resp, err := tm.bootstrapClient.Bootstrap(ctx, tm.bootstrapToken)
+	ch := tm.refreshGroup.DoChan("refresh", func() (interface{}, error) {
+		// The refresh is shared by all waiting callers, so it must not be
+		// cancelled because the caller that started it gave up
+		refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		return nil, tm.doRefresh(refreshCtx)
+	})
+
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (tm *TokenManager) doRefresh(ctx context.Context) error {
+	tm.bootstrapMu.Lock()
+	defer tm.bootstrapMu.Unlock()
+
+	start := time.Now()
+	resp, err := tm.bootstrap(ctx, tm.BootstrapToken())
+	tm.recordRefresh(start, err)
 	if err != nil {
 		// Check if it's a permanent error (410)
 		if IsPermanentError(err) {
 			tm.mu.Lock()
+			wasDeleted := tm.deploymentDeleted
 			tm.deploymentDeleted = true
 			tm.mu.Unlock()
-			logger.Warn("Deployment has been permanently deleted (410) during refresh. Stopping refresh loop")
+			tm.clearCache()
+			if !wasDeleted {
+				logger.Warn("Deployment has been permanently deleted (410) during refresh. Stopping refresh loop")
+			}
+			return err
+		}
+		if IsRevokedError(err) {
 			return err
 		}
 		return errors.New("token refresh failed: " + err.Error())
 	}
 
+	tm.store(resp)
+
+	logger.Debug("Token refreshed successfully",
+		"expires_in", resp.ExpiresIn)
+
+	return nil
+}
+
+// recordRefresh exports the outcome and latency of a refresh and tracks
+// whether the bootstrap token is revoked
+func (tm *TokenManager) recordRefresh(start time.Time, err error) {
+	metrics.TokenRefreshDuration.Observe(time.Since(start).Seconds())
+
+	status := "success"
+	switch {
+	case err == nil:
+	case IsPermanentError(err):
+		status = "deleted"
+	case IsRevokedError(err):
+		status = "revoked"
+	default:
+		status = "failure"
+	}
+	metrics.TokenRefreshesTotal.WithLabelValues(status).Inc()
+
+	tm.mu.Lock()
+	tm.lastRefreshError = err
+	tm.mu.Unlock()
+
+	// Transient failures leave the revoked state as it was
+	if status != "success" && status != "revoked" {
+		return
+	}
+	revoked := status == "revoked"
+
+	tm.mu.Lock()
+	wasRevoked := tm.tokenRevoked
+	tm.tokenRevoked = revoked
+	tm.mu.Unlock()
+
+	if revoked == wasRevoked {
+		return
+	}
+	if revoked {
+		metrics.TokenRevoked.Set(1)
+		logger.Error("Bootstrap token was rejected by the platform (401/403). Rotate the token to recover",
+			"fingerprint", TokenFingerprint(tm.BootstrapToken()))
+	} else {
+		metrics.TokenRevoked.Set(0)
+		logger.Info("Bootstrap token accepted again")
+	}
+}
+
+// bootstrap exchanges bootstrapToken for an access token and verifies the
+// response
+func (tm *TokenManager) bootstrap(ctx context.Context, bootstrapToken string) (*BootstrapResponse, error) {
+	// Check the pinned issuer first, so the token is never sent elsewhere
+	if err := tm.checkIssuer(bootstrapToken); err != nil {
+		return nil, err
+	}
+
+	resp, err := tm.bootstrapClient.Bootstrap(ctx, bootstrapToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := tm.verify(resp, bootstrapToken); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (tm *TokenManager) store(resp *BootstrapResponse) {
 	tm.mu.Lock()
 	tm.currentToken = resp.AccessToken
 	tm.tokenExpiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
 	tm.configURL = resp.ConfigURL
 	tm.logsURL = resp.LogsURL
+	tm.scopes = resp.Scopes
 	tm.mu.Unlock()
 
-	logger.Debug("Token refreshed successfully",
-		"expires_in", resp.ExpiresIn)
+	tm.persist()
+}
+
+// SaveEDLConfig persists the last EDL configuration read from the platform
+// next to the access token, so a restart can use it while the platform is
+// unreachable
+func (tm *TokenManager) SaveEDLConfig(edlConfig *EDLConfig) {
+	tm.mu.Lock()
+	changed := !reflect.DeepEqual(tm.edlConfig, edlConfig)
+	tm.edlConfig = edlConfig
+	tm.mu.Unlock()
+
+	if changed {
+		tm.persist()
+	}
+}
+
+// CachedEDLConfig returns the EDL configuration persisted with the cached
+// access token, or nil if there is none
+func (tm *TokenManager) CachedEDLConfig() *EDLConfig {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.edlConfig
+}
+
+// persist writes the current token and EDL configuration to the cache
+func (tm *TokenManager) persist() {
+	if tm.cache == nil {
+		return
+	}
+
+	tm.mu.RLock()
+	cached := &cachedToken{
+		AccessToken:          tm.currentToken,
+		ExpiresAt:            tm.tokenExpiry,
+		ConfigURL:            tm.configURL,
+		LogsURL:              tm.logsURL,
+		Scopes:               tm.scopes,
+		EDLConfig:            tm.edlConfig,
+		BootstrapFingerprint: TokenFingerprint(tm.bootstrapToken),
+	}
+	bootstrapToken := tm.bootstrapToken
+	tm.mu.RUnlock()
+
+	if cached.AccessToken == "" {
+		return
+	}
+	if err := tm.cache.save(bootstrapToken, cached); err != nil {
+		logger.Warn("Failed to persist access token", "path", tm.cache.path, "error", err)
+	}
+}
 
+// loadCached adopts a persisted access token that is still valid and
+// bootstraps in the background to replace it. It reports whether a cached
+// token was used.
+func (tm *TokenManager) loadCached() bool {
+	if tm.cache == nil {
+		return false
+	}
+
+	cached, err := tm.cache.load(tm.BootstrapToken())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Debug("Not using cached access token", "error", err)
+		}
+		return false
+	}
+
+	tm.mu.Lock()
+	tm.currentToken = cached.AccessToken
+	tm.tokenExpiry = cached.ExpiresAt
+	tm.configURL = cached.ConfigURL
+	tm.logsURL = cached.LogsURL
+	tm.scopes = cached.Scopes
+	if tm.scopes == nil {
+		tm.scopes = tm.bootstrapClient.scopes
+	}
+	tm.edlConfig = cached.EDLConfig
+	tm.mu.Unlock()
+
+	logger.Info("Using cached access token, bootstrapping in background",
+		"expires_in", time.Until(cached.ExpiresAt).Round(time.Second))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := tm.refresh(ctx); err != nil {
+			logger.Warn("Background bootstrap failed, continuing with cached token", "error", err)
+		}
+	}()
+
+	return true
+}
+
+func (tm *TokenManager) clearCache() {
+	if tm.cache != nil {
+		tm.cache.clear()
+	}
+}
+
+// checkIssuer rejects bootstrap tokens not issued by the pinned issuer
+func (tm *TokenManager) checkIssuer(bootstrapToken string) error {
+	if tm.pinnedIssuer == "" {
+		return nil
+	}
+
+	issuer, _, _, err := tm.bootstrapClient.parseBootstrapToken(bootstrapToken)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSuffix(issuer, "/") != strings.TrimSuffix(tm.pinnedIssuer, "/") {
+		metrics.TokenVerificationFailuresTotal.WithLabelValues("bootstrap").Inc()
+		return errors.New("bootstrap token issuer " + issuer + " does not match pinned issuer " + tm.pinnedIssuer)
+	}
 	return nil
 }
 
+// verify checks a bootstrap response against the platform JWKS before
+// any of it is trusted. Both the bootstrap token and the issued access
+// token must be signed by a key from the pinned JWKS, or else from the
+// issuer's JWKS, and the config and logs URLs must be on the issuer's host.
+func (tm *TokenManager) verify(resp *BootstrapResponse, bootstrapToken string) error {
+	issuer, _, _, err := tm.bootstrapClient.parseBootstrapToken(bootstrapToken)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPlatformURL("config_url", resp.ConfigURL, issuer); err != nil {
+		return err
+	}
+	if resp.LogsURL != "" {
+		if err := checkPlatformURL("logs_url", resp.LogsURL, issuer); err != nil {
+			return err
+		}
+	}
+
+	jwksURL := tm.pinnedJWKSURL
+	if jwksURL == "" {
+		if err := checkJWKSURL(resp.JWKSUrl, issuer); err != nil {
+			return err
+		}
+		jwksURL = resp.JWKSUrl
+	}
+
+	tm.mu.Lock()
+	if tm.jwks == nil || tm.jwks.URL() != jwksURL {
+		tm.jwks = NewJWKSCache(jwksURL)
+	}
+	jwks := tm.jwks
+	tm.mu.Unlock()
+
+	if err := verifyToken(jwks, "bootstrap", bootstrapToken, issuer, false); err != nil {
+		return err
+	}
+	return verifyToken(jwks, "access", resp.AccessToken, issuer, true)
+}
+
+// Probe re-attempts bootstrap for a deployment previously reported as
+// deleted. On success the deployment is marked active again and the
+// refresh loop resumes; while it is still deleted a PermanentError is
+// returned.
+func (tm *TokenManager) Probe(ctx context.Context) error {
+	if err := tm.refresh(ctx); err != nil {
+		return err
+	}
+
+	tm.resume()
+	return nil
+}
+
+// SetBootstrapToken replaces the bootstrap token, e.g. after the secret
+// file was rotated. The new token is only adopted once a bootstrap with it
+// succeeded; on failure the current token and access token stay in use.
+func (tm *TokenManager) SetBootstrapToken(ctx context.Context, bootstrapToken string) error {
+	tm.bootstrapMu.Lock()
+	start := time.Now()
+	resp, err := tm.bootstrap(ctx, bootstrapToken)
+	if err != nil {
+		// The current token stays in use, so its refresh status is kept
+		tm.bootstrapMu.Unlock()
+		return err
+	}
+	// A successful rotation clears a revoked state and the last refresh
+	// error right away instead of at the next scheduled refresh
+	tm.recordRefresh(start, nil)
+
+	tm.mu.Lock()
+	tm.bootstrapToken = bootstrapToken
+	tm.mu.Unlock()
+	tm.store(resp)
+	tm.bootstrapMu.Unlock()
+
+	logger.Info("Bootstrap token rotated", "fingerprint", TokenFingerprint(bootstrapToken))
+
+	tm.resume()
+	return nil
+}
+
+// resume clears the deleted flag after a successful bootstrap and restarts
+// the refresh loop if it had stopped
+func (tm *TokenManager) resume() {
+	tm.mu.Lock()
+	wasDeleted := tm.deploymentDeleted
+	tm.deploymentDeleted = false
+	loopCtx := tm.loopCtx
+	tm.mu.Unlock()
+
+	if wasDeleted {
+		logger.Info("Deployment is available again, resuming token refresh")
+	}
+	if loopCtx != nil {
+		tm.StartRefreshLoop(loopCtx)
+	}
+}
+
+// BootstrapToken returns the bootstrap token currently in use
+func (tm *TokenManager) BootstrapToken() string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.bootstrapToken
+}
+
 func (tm *TokenManager) GetToken() string {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
@@ -163,12 +565,40 @@ func (tm *TokenManager) GetConfigURL() string {
 	return tm.configURL
 }
 
+// GetLogsURL returns the log ingestion URL, or an empty string when the
+// platform did not grant the logs scope
 func (tm *TokenManager) GetLogsURL() string {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
+	if !slices.Contains(tm.scopes, ScopeLogs) {
+		return ""
+	}
 	return tm.logsURL
 }
 
+// HasScope reports whether the platform granted scope
+func (tm *TokenManager) HasScope(scope string) bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return slices.Contains(tm.scopes, scope)
+}
+
+// IsTokenRevoked reports whether the platform rejected the bootstrap token
+// on the last refresh
+func (tm *TokenManager) IsTokenRevoked() bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.tokenRevoked
+}
+
+// LastRefreshError returns the error of the most recent bootstrap, or nil
+// if it succeeded
+func (tm *TokenManager) LastRefreshError() error {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.lastRefreshError
+}
+
 func (tm *TokenManager) IsDeploymentDeleted() bool {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
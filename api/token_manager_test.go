@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefreshSurvivesCancelledCaller(t *testing.T) {
+	p := newTestPlatform(t)
+	p.bootstrapDelay = 200 * time.Millisecond
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig})
+
+	cancelled, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var firstErr, secondErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		firstErr = tm.refresh(cancelled)
+	}()
+	go func() {
+		defer wg.Done()
+		// Join the refresh started by the first caller
+		time.Sleep(5 * time.Millisecond)
+		secondErr = tm.refresh(context.Background())
+	}()
+	wg.Wait()
+
+	if !errors.Is(firstErr, context.DeadlineExceeded) {
+		t.Errorf("cancelled caller error = %v, want deadline exceeded", firstErr)
+	}
+	if secondErr != nil {
+		t.Errorf("waiting caller failed: %v", secondErr)
+	}
+	if hits := p.bootstrapHits.Load(); hits != 1 {
+		t.Errorf("bootstrap requests = %d, want 1", hits)
+	}
+	if tm.GetToken() == "" {
+		t.Error("no access token after refresh")
+	}
+}
+
+func TestSetBootstrapTokenSerializedWithRefresh(t *testing.T) {
+	p := newTestPlatform(t)
+	p.bootstrapDelay = 50 * time.Millisecond
+	tm := NewTokenManager(p.sign(t, p.server.URL, time.Hour), []string{ScopeConfig})
+	rotated := p.sign(t, p.server.URL, 2*time.Hour)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := tm.refresh(context.Background()); err != nil {
+			t.Errorf("refresh: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := tm.SetBootstrapToken(context.Background(), rotated); err != nil {
+			t.Errorf("SetBootstrapToken: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	// Both bootstraps ran, one after the other
+	if hits := p.bootstrapHits.Load(); hits != 2 {
+		t.Errorf("bootstrap requests = %d, want 2", hits)
+	}
+	if elapsed := time.Since(start); elapsed < 2*p.bootstrapDelay {
+		t.Errorf("bootstraps overlapped, took %v", elapsed)
+	}
+	if tm.BootstrapToken() != rotated {
+		t.Error("rotated bootstrap token not adopted")
+	}
+}
+
+func TestRotationAfterRevocationRecovers(t *testing.T) {
+	p := newTestPlatform(t)
+	revoked := p.sign(t, p.server.URL, time.Hour)
+	p.revoke(revoked)
+	tm := NewTokenManager(revoked, []string{ScopeConfig})
+
+	if err := tm.refresh(context.Background()); !IsRevokedError(err) {
+		t.Fatalf("refresh error = %v, want revoked", err)
+	}
+	if !tm.IsTokenRevoked() || tm.LastRefreshError() == nil {
+		t.Fatal("revocation not recorded")
+	}
+
+	// A rotation to another revoked token keeps the current status
+	other := p.sign(t, p.server.URL, 2*time.Hour)
+	p.revoke(other)
+	if err := tm.SetBootstrapToken(context.Background(), other); err == nil {
+		t.Fatal("rotation to a revoked token succeeded")
+	}
+	if tm.BootstrapToken() != revoked || !tm.IsTokenRevoked() {
+		t.Error("failed rotation changed the current token or its status")
+	}
+
+	rotated := p.sign(t, p.server.URL, 3*time.Hour)
+	if err := tm.SetBootstrapToken(context.Background(), rotated); err != nil {
+		t.Fatalf("rotation failed: %v", err)
+	}
+	if tm.IsTokenRevoked() {
+		t.Error("token still reported revoked after rotation")
+	}
+	if err := tm.LastRefreshError(); err != nil {
+		t.Errorf("last refresh error after rotation = %v, want nil", err)
+	}
+}
+
+func TestFailedRotationKeepsCurrentToken(t *testing.T) {
+	p := newTestPlatform(t)
+	current := p.sign(t, p.server.URL, time.Hour)
+	tm := NewTokenManager(current, []string{ScopeConfig})
+	if err := tm.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	accessToken := tm.GetToken()
+
+	rejected := p.sign(t, p.server.URL, 2*time.Hour)
+	p.revoke(rejected)
+	for _, token := range []string{"not-a-token", rejected} {
+		if err := tm.SetBootstrapToken(context.Background(), token); err == nil {
+			t.Fatalf("rotation to %q succeeded", token)
+		}
+		if tm.BootstrapToken() != current {
+			t.Error("failed rotation replaced the bootstrap token")
+		}
+		if tm.GetToken() != accessToken {
+			t.Error("failed rotation replaced the access token")
+		}
+		if tm.IsTokenRevoked() {
+			t.Error("failed rotation marked the current token revoked")
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+)
+
+const (
+	// blockPageName is the default block page template. Translations sit
+	// next to it as 403.<language>.html, e.g. 403.de.html or 403.pt-br.html.
+	blockPageName = "403.html"
+	// blockPageLanguage is the language of the default template
+	blockPageLanguage = "en"
+)
+
+// blockPageData is passed to the block page templates
+type blockPageData struct {
+	Status         int
+	ClientIP       string
+	RequestID      string
+	Host           string
+	Timestamp      string
+	SupportContact string
+}
+
+// BlockPage renders the page shown to denied browser requests. Templates
+// are parsed once and cached; Watch reloads them when the files change.
+type BlockPage struct {
+	dir            string
+	supportContact string
+
+	mu        sync.RWMutex
+	templates map[string]*template.Template
+	modTime   time.Time
+}
+
+// NewBlockPage returns a block page served from the templates in dir.
+// Nothing is rendered until Load finds 403.html; translations are
+// optional.
+func NewBlockPage(dir, supportContact string) *BlockPage {
+	return &BlockPage{
+		dir:            dir,
+		supportContact: supportContact,
+	}
+}
+
+func (b *BlockPage) files() ([]string, error) {
+	return filepath.Glob(filepath.Join(b.dir, "403*.html"))
+}
+
+// Load parses the templates, replacing the ones in use. It fails if
+// 403.html is missing or a template does not parse.
+func (b *BlockPage) Load() error {
+	files, err := b.files()
+	if err != nil {
+		return err
+	}
+
+	templates := map[string]*template.Template{}
+	var modTime time.Time
+	for _, file := range files {
+		name := filepath.Base(file)
+		lang := ""
+		if name != blockPageName {
+			lang = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "403."), ".html"))
+		}
+
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return errors.New("failed to parse " + name + ": " + err.Error())
+		}
+		templates[lang] = tmpl
+
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	if templates[""] == nil {
+		return errors.New(blockPageName + " not found in " + b.dir)
+	}
+
+	b.mu.Lock()
+	b.templates = templates
+	b.modTime = modTime
+	b.mu.Unlock()
+
+	logger.Debug("Block page templates loaded", "dir", b.dir, "templates", len(templates))
+	return nil
+}
+
+// Watch reloads the templates every interval if any of them changed, so a
+// block page added after startup is picked up too. A template that fails
+// to parse keeps the previous version in use.
+func (b *BlockPage) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !b.changed() {
+					continue
+				}
+				if err := b.Load(); err != nil {
+					logger.Error("Failed to reload block page, keeping current templates", "error", err)
+				} else {
+					logger.Info("Block page templates reloaded")
+				}
+			}
+		}
+	}()
+}
+
+func (b *BlockPage) changed() bool {
+	files, err := b.files()
+	if err != nil {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(files) != len(b.templates) {
+		return true
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(b.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Render writes the block page in the language preferred by the request
+// with the given status code, showing at as the time of the decision. Nothing is written if rendering fails.
+func (b *BlockPage) Render(w http.ResponseWriter, r *http.Request, status int, clientIP, requestID string, at time.Time) error {
+	b.mu.RLock()
+	tmpl := b.templates[b.language(r.Header.Get("Accept-Language"))]
+	b.mu.RUnlock()
+	if tmpl == nil {
+		return errors.New("no block page loaded from " + b.dir)
+	}
+
+	data := blockPageData{
+		Status:         status,
+		ClientIP:       clientIP,
+		RequestID:      requestID,
+		Host:           r.Header.Get("X-Forwarded-Host"),
+		Timestamp:      at.UTC().Format(time.RFC3339),
+		SupportContact: b.supportContact,
+	}
+
+	// Render fully before writing, so a template error can still fall
+	// back to a plain response
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", contentLanguage(tmpl))
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Error("Failed to serve block page", "error", err)
+	}
+	return nil
+}
+
+// language picks the best available template for an Accept-Language
+// header. Exact tags are preferred over their primary language, and ""
+// selects the default template. Callers must hold b.mu.
+func (b *BlockPage) language(acceptLanguage string) string {
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		primary, _, _ := strings.Cut(tag, "-")
+		for _, candidate := range []string{tag, primary} {
+			if _, ok := b.templates[candidate]; ok {
+				return candidate
+			}
+			if candidate == blockPageLanguage {
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language
+// header, lowercased and ordered by preference
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag: tag, q: q})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
+
+// contentLanguage derives the Content-Language of a template from its
+// file name
+func contentLanguage(tmpl *template.Template) string {
+	name := tmpl.Name()
+	if name == blockPageName {
+		return blockPageLanguage
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "403."), ".html")
+}
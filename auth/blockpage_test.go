@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlockPageLoadedAfterStartup(t *testing.T) {
+	dir := t.TempDir()
+	b := NewBlockPage(dir, "")
+	if err := b.Load(); err == nil {
+		t.Fatal("Load succeeded without 403.html")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	if err := b.Render(httptest.NewRecorder(), r, http.StatusForbidden, "192.0.2.1", "id", time.Now()); err == nil {
+		t.Fatal("Render succeeded before a block page was loaded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.Watch(ctx, 10*time.Millisecond)
+
+	page := "<p>{{.Status}} {{.RequestID}}</p>"
+	if err := os.WriteFile(filepath.Join(dir, blockPageName), []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		if err := b.Render(w, r, http.StatusForbidden, "192.0.2.1", "id", time.Now()); err == nil {
+			if got := w.Body.String(); got != "<p>403 id</p>" {
+				t.Errorf("body = %q", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("block page not picked up by Watch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// CallerAuth verifies that auth requests come from a trusted Traefik
+// instance, which adds a static header with a shared secret. In HMAC mode
+// the header instead carries "sha256=<hex>" of the HMAC-SHA256 of the
+// X-Forwarded-Host value, so a header leaked from one router does not
+// authenticate requests for other hosts. The signature is still a static
+// value per host that can be replayed indefinitely, since Traefik can only
+// add fixed headers; it scopes the secret but is no stronger than it.
+type CallerAuth struct {
+	header   string
+	secret   []byte
+	hmacMode bool
+}
+
+func NewCallerAuth(header, secret string, hmacMode bool) *CallerAuth {
+	return &CallerAuth{
+		header:   http.CanonicalHeaderKey(header),
+		secret:   []byte(secret),
+		hmacMode: hmacMode,
+	}
+}
+
+// verify checks the request and returns the rejection reason ("missing" or
+// "invalid") if it is not authenticated
+func (c *CallerAuth) verify(r *http.Request) (string, bool) {
+	value := r.Header.Get(c.header)
+	if value == "" {
+		return "missing", false
+	}
+
+	if !c.hmacMode {
+		if subtle.ConstantTimeCompare([]byte(value), c.secret) != 1 {
+			return "invalid", false
+		}
+		return "", true
+	}
+
+	signature, ok := strings.CutPrefix(value, "sha256=")
+	if !ok {
+		return "invalid", false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return "invalid", false
+	}
+
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(r.Header.Get("X-Forwarded-Host")))
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return "invalid", false
+	}
+	return "", true
+}
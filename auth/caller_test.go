@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+)
+
+func hmacHeader(secret, host string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(host))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCallerAuth(t *testing.T) {
+	const secret = "s3cret"
+
+	tests := []struct {
+		name       string
+		hmacMode   bool
+		host       string
+		value      string
+		wantReason string
+	}{
+		{"token accepted", false, "app.example.com", secret, ""},
+		{"token missing", false, "app.example.com", "", "missing"},
+		{"token wrong", false, "app.example.com", "guess", "invalid"},
+		{"token prefix", false, "app.example.com", secret[:3], "invalid"},
+		{"hmac accepted", true, "app.example.com", hmacHeader(secret, "app.example.com"), ""},
+		{"hmac missing", true, "app.example.com", "", "missing"},
+		{"hmac other host", true, "other.example.com", hmacHeader(secret, "app.example.com"), "invalid"},
+		{"hmac wrong secret", true, "app.example.com", hmacHeader("other", "app.example.com"), "invalid"},
+		{"hmac without prefix", true, "app.example.com", hmacHeader(secret, "app.example.com")[len("sha256="):], "invalid"},
+		{"hmac not hex", true, "app.example.com", "sha256=zz", "invalid"},
+		{"hmac plain secret", true, "app.example.com", secret, "invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCallerAuth("X-Forwardauth-Secret", secret, tt.hmacMode)
+
+			r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+			r.Header.Set("X-Forwarded-Host", tt.host)
+			if tt.value != "" {
+				r.Header.Set("X-Forwardauth-Secret", tt.value)
+			}
+
+			reason, ok := c.verify(r)
+			if ok != (tt.wantReason == "") || reason != tt.wantReason {
+				t.Errorf("verify() = %q, %v, want %q", reason, ok, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestUnauthenticatedCallerRejected(t *testing.T) {
+	h := NewHandler(blockedMatcher(t, "192.0.2.1"), "blocklist", config.DeploymentActive)
+	h.SetCallerAuth(NewCallerAuth("X-Forwardauth-Secret", "s3cret", false))
+
+	for value, want := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"guess":  http.StatusUnauthorized,
+		"s3cret": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		if value != "" {
+			r.Header.Set("X-Forwardauth-Secret", value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != want {
+			t.Errorf("secret %q: status = %d, want %d", value, w.Code, want)
+		}
+	}
+}
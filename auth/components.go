@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logs"
+)
+
+// ComponentStatus is the health of a single component, or of the service
+// as a whole
+type ComponentStatus string
+
+const (
+	StatusOK       ComponentStatus = "ok"
+	StatusDegraded ComponentStatus = "degraded"
+	StatusFailing  ComponentStatus = "failing"
+)
+
+// severity orders statuses so the overall status is the worst one
+func (s ComponentStatus) severity() int {
+	switch s {
+	case StatusFailing:
+		return 2
+	case StatusDegraded:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ComponentHealth is the result of one component check
+type ComponentHealth struct {
+	Status  ComponentStatus        `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// bufferDegradedFill is the log buffer fill ratio reported as degraded
+const bufferDegradedFill = 0.9
+
+func (h *HealthHandler) checkEDL() ComponentHealth {
+	lastUpdate, lastError, updateCount, entryCount := h.updater.GetStatus()
+	age, stale := h.updater.Staleness()
+
+	result := ComponentHealth{
+		Status: StatusOK,
+		Details: map[string]interface{}{
+			"update_count":    updateCount,
+			"entry_count":     entryCount,
+			"max_age_seconds": h.updater.MaxAge().Seconds(),
+			"stale":           stale,
+		},
+	}
+	if !lastUpdate.IsZero() {
+		result.Details["last_update"] = lastUpdate.Format(time.RFC3339)
+		result.Details["age_seconds"] = age.Seconds()
+	}
+	if lastError != nil {
+		result.Details["last_error"] = lastError.Error()
+	}
+
+	cause, _, _ := h.handler.FailureStatus()
+	switch {
+	case cause == config.CauseDeploymentDisabled || cause == config.CauseDeploymentDeleted:
+		result.Message = "deployment " + string(cause)
+	case lastUpdate.IsZero():
+		result.Status = StatusFailing
+		result.Message = "EDL not yet loaded"
+	case stale:
+		result.Status = StatusDegraded
+		result.Message = "EDL is stale"
+	case lastError != nil:
+		result.Status = StatusDegraded
+		result.Message = "last update failed"
+	}
+
+	return result
+}
+
+func checkTokenManager(tm *api.TokenManager) ComponentHealth {
+	expiresIn := tm.TimeUntilExpiry()
+	deleted := tm.IsDeploymentDeleted()
+	revoked := tm.IsTokenRevoked()
+	refreshErr := tm.LastRefreshError()
+
+	result := ComponentHealth{
+		Status: StatusOK,
+		Details: map[string]interface{}{
+			"expires_in_seconds": expiresIn.Seconds(),
+			"deployment_deleted": deleted,
+			"token_revoked":      revoked,
+		},
+	}
+	if refreshErr != nil {
+		result.Details["last_refresh_error"] = refreshErr.Error()
+	}
+
+	switch {
+	case revoked:
+		result.Status = StatusFailing
+		result.Message = "bootstrap token revoked"
+	case deleted:
+		// A deleted deployment is handled by its fail mode
+		result.Status = StatusDegraded
+		result.Message = "deployment deleted"
+	case expiresIn <= 0:
+		result.Status = StatusFailing
+		result.Message = "access token expired"
+	case refreshErr != nil:
+		result.Status = StatusDegraded
+		result.Message = "last refresh failed"
+	}
+
+	return result
+}
+
+func checkConfigWatcher(watcher *config.Watcher) ComponentHealth {
+	version, lastCheck, lastError := watcher.GetStatus()
+
+	result := ComponentHealth{
+		Status: StatusOK,
+		Details: map[string]interface{}{
+			"version": version,
+			"state":   watcher.State().String(),
+		},
+	}
+	if !lastCheck.IsZero() {
+		result.Details["last_check"] = lastCheck.Format(time.RFC3339)
+	}
+	if lastError != nil {
+		result.Status = StatusDegraded
+		result.Message = "last config poll failed"
+		result.Details["last_error"] = lastError.Error()
+	}
+
+	return result
+}
+
+func checkLogShipper(shipper *logs.LogShipper) ComponentHealth {
+	status := shipper.Status()
+
+	fill := 0.0
+	if status.BufferCapacity > 0 {
+		fill = float64(status.Buffered) / float64(status.BufferCapacity)
+	}
+
+	result := ComponentHealth{
+		Status: StatusOK,
+		Details: map[string]interface{}{
+			"circuit_open":   status.CircuitOpen,
+			"buffered":       status.Buffered,
+			"buffer_fill":    fill,
+			"events_dropped": status.EventsDropped,
+		},
+	}
+
+	switch {
+	case status.CircuitOpen:
+		result.Status = StatusDegraded
+		result.Message = "circuit breaker open"
+	case fill >= bufferDegradedFill:
+		result.Status = StatusDegraded
+		result.Message = "log buffer nearly full"
+	}
+
+	return result
+}
+
+// checkComponents runs all component checks and returns them with the
+// overall status, which is the worst of the individual ones
+func (h *HealthHandler) checkComponents() (ComponentStatus, map[string]ComponentHealth) {
+	components := map[string]ComponentHealth{
+		"edl": h.checkEDL(),
+	}
+	if h.tokenManager != nil {
+		components["token_manager"] = checkTokenManager(h.tokenManager)
+	}
+	if h.watcher != nil {
+		components["config"] = checkConfigWatcher(h.watcher)
+	}
+	if h.logShipper != nil {
+		components["log_shipper"] = checkLogShipper(h.logShipper)
+	}
+
+	overall := StatusOK
+	for _, c := range components {
+		if c.Status.severity() > overall.severity() {
+			overall = c.Status
+		}
+	}
+	return overall, components
+}
@@ -1,15 +1,19 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"io"
 	"net"
 	"net/http"
 	"net/netip"
-	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/edl"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logs"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
@@ -17,23 +21,73 @@ import (
 	"github.com/getsentry/sentry-go"
 )
 
-// HTML content for the 403 page will be loaded from file system
+const (
+	// staleHeader marks responses decided while the EDL exceeded its max
+	// age; edlAgeHeader carries the age in seconds
+	staleHeader  = "X-Forwardauth-Stale"
+	edlAgeHeader = "X-Forwardauth-EDL-Age"
+)
 
 type Handler struct {
-	matcher           *ipmatcher.Matcher
-	isBlocklist       bool
-	deploymentEnabled bool
-	logShipper        *logs.LogShipper
-	deviceID          string
-	ipHeaderOverride  string
+	matcher          *ipmatcher.Matcher
+	updater          *edl.Updater
+	isBlocklist      atomic.Bool
+	hasMode          atomic.Bool
+	state            atomic.Int32
+	policies         config.Policies
+	logShipper       *logs.LogShipper
+	deviceID         string
+	ipHeaderOverride string
+	callerAuth       *CallerAuth
+	blockPage        *BlockPage
+	redirectSecret   []byte
+}
+
+// decision is the outcome of evaluating a request
+type decision struct {
+	allowed bool
+	reason  string
+	mode    string
+	// stale is set when the EDL exceeded its max age
+	stale bool
 }
 
-func NewHandler(matcher *ipmatcher.Matcher, edlMode string, deploymentEnabled bool) *Handler {
-	return &Handler{
-		matcher:           matcher,
-		isBlocklist:       edlMode == "blocklist",
-		deploymentEnabled: deploymentEnabled,
+func NewHandler(matcher *ipmatcher.Matcher, edlMode string, state config.DeploymentState) *Handler {
+	h := &Handler{
+		matcher: matcher,
 	}
+	h.SetMode(edlMode)
+	h.SetDeploymentState(state)
+	return h
+}
+
+// SetMode switches between blocklist and allowlist evaluation until a
+// list is loaded; from then on the mode published with the list is used.
+// Other values (such as "disabled") are ignored so that the last known
+// mode is kept for last-known-good evaluation.
+// It is safe to call while requests are being served.
+func (h *Handler) SetMode(edlMode string) {
+	if edlMode != "blocklist" && edlMode != "allowlist" {
+		return
+	}
+	h.isBlocklist.Store(edlMode == "blocklist")
+	h.hasMode.Store(true)
+}
+
+// SetDeploymentState sets the deployment state decisions are made in.
+// It is safe to call while requests are being served.
+func (h *Handler) SetDeploymentState(state config.DeploymentState) {
+	h.state.Store(int32(state))
+}
+
+// SetUpdater sets the updater used to judge EDL staleness
+func (h *Handler) SetUpdater(updater *edl.Updater) {
+	h.updater = updater
+}
+
+// SetPolicies sets the per-purpose fail mode policies
+func (h *Handler) SetPolicies(policies config.Policies) {
+	h.policies = policies
 }
 
 func (h *Handler) SetLogShipper(shipper *logs.LogShipper) {
@@ -48,9 +102,40 @@ func (h *Handler) SetIPHeaderOverride(headerName string) {
 	h.ipHeaderOverride = headerName
 }
 
+// SetBlockPage sets the page rendered for denied browser requests
+func (h *Handler) SetBlockPage(blockPage *BlockPage) {
+	h.blockPage = blockPage
+}
+
+// SetRedirectSecret sets the key reason tokens in denial redirects are
+// signed with. Without it, redirects carry no reason token.
+func (h *Handler) SetRedirectSecret(secret []byte) {
+	h.redirectSecret = secret
+}
+
+// SetCallerAuth requires auth requests to carry the shared secret checked
+// by callerAuth
+func (h *Handler) SetCallerAuth(callerAuth *CallerAuth) {
+	h.callerAuth = callerAuth
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
+	// Unauthenticated callers learn nothing about the EDL
+	if h.callerAuth != nil {
+		if reason, ok := h.callerAuth.verify(r); !ok {
+			metrics.RequestsTotal.WithLabelValues("unauthenticated").Inc()
+			metrics.RequestDuration.WithLabelValues("unauthenticated").Observe(time.Since(start).Seconds())
+			metrics.CallerAuthFailuresTotal.WithLabelValues(reason).Inc()
+			logger.Debug("Rejected unauthenticated auth request",
+				"reason", reason,
+				"remote_addr", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	clientIP := h.extractClientIP(r)
 	if clientIP == "" {
 		metrics.RequestsTotal.WithLabelValues("invalid").Inc()
@@ -63,7 +148,15 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	allowed, err := h.evaluateAccess(clientIP)
+	d, err := h.evaluateAccess(clientIP)
+	// A hidden denial must not reveal that an EDL was consulted
+	if err == nil && d.stale && (d.allowed || !h.policies.ForMode(d.mode).HidesDenial()) {
+		w.Header().Set(staleHeader, "true")
+		if h.updater != nil {
+			age, _ := h.updater.Staleness()
+			w.Header().Set(edlAgeHeader, strconv.FormatInt(int64(age.Seconds()), 10))
+		}
+	}
 	if err != nil {
 		// Invalid IP address error
 		metrics.RequestsTotal.WithLabelValues("invalid").Inc()
@@ -76,7 +169,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if allowed {
+	if d.allowed {
 		metrics.RequestsTotal.WithLabelValues("allowed").Inc()
 		metrics.RequestDuration.WithLabelValues("allowed").Observe(time.Since(start).Seconds())
 		w.WriteHeader(http.StatusOK)
@@ -84,52 +177,187 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		metrics.RequestsTotal.WithLabelValues("denied").Inc()
 		metrics.RequestDuration.WithLabelValues("denied").Observe(time.Since(start).Seconds())
 
+		// The same ID and time are shown to the client, logged and
+		// shipped, so a reported denial can be traced
+		id := requestID(r)
+		at := time.Now().UTC()
+		logger.Info("Denied request",
+			"ip", clientIP,
+			"reason", d.reason,
+			"request_id", id)
+
 		// Send block event to log shipper
 		if h.logShipper != nil {
-			h.sendAccessEvent(clientIP, r, false)
+			h.sendAccessEvent(clientIP, r, d, id, at)
 		}
 
-		h.serveForbidden(w, r)
+		h.serveForbidden(w, r, clientIP, d, id, at)
 	}
 }
 
-func (h *Handler) serveForbidden(w http.ResponseWriter, r *http.Request) {
+// serveForbidden answers a denied request with the status code of the
+// policy in effect, as a block page, problem details or plain text
+// depending on what the client accepts. Browsers are redirected instead
+// when the policy sets a redirect URL. A 404 status hides that the
+// request was denied, so no block page, redirect or reason is sent.
+func (h *Handler) serveForbidden(w http.ResponseWriter, r *http.Request, clientIP string, d decision, id string, at time.Time) {
+	policy := h.policies.ForMode(d.mode)
+	status := policy.DenyStatusCode()
+	hidden := policy.HidesDenial()
+
+	if redirectsDenial(r, policy) {
+		target, err := h.redirectURL(r, policy, clientIP, id, at, d)
+		if err == nil {
+			http.Redirect(w, r, target, policy.RedirectStatus)
+			return
+		}
+		logger.Error("Failed to build denial redirect", "error", err)
+	}
+
 	accept := r.Header.Get("Accept")
-	if strings.Contains(accept, "text/html") {
-		file, err := os.Open("/static/403.html")
-		if err != nil {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+	if h.blockPage != nil && !hidden && strings.Contains(accept, "text/html") {
+		err := h.blockPage.Render(w, r, status, clientIP, id, at)
+		if err == nil {
 			return
 		}
-		defer file.Close()
+		logger.Error("Failed to render block page", "error", err)
+	}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusForbidden)
-		if _, err := io.Copy(w, file); err != nil {
-			logger.Error("Failed to serve 403 page", "error", err)
+	if acceptsJSON(accept) {
+		p := problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(status),
+			Status:    status,
+			RequestID: id,
+			Timestamp: at.Format(time.RFC3339),
 		}
-	} else {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+		if !hidden {
+			p.Detail = "Access to this resource is denied."
+			p.Reason = d.reason
+		}
+		writeProblem(w, p)
+		return
 	}
+
+	http.Error(w, http.StatusText(status), status)
 }
 
-// evaluateAccess determines if the client IP should be allowed
-func (h *Handler) evaluateAccess(clientIP string) (bool, error) {
-	// If deployment is disabled, allow all traffic
-	if !h.deploymentEnabled {
-		return true, nil
+// requestID returns the request ID set by the proxy, or a random one so
+// that a block page can still be correlated with the logs
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
 	}
+	return hex.EncodeToString(b)
+}
 
+// evaluateAccess determines if the client IP should be allowed. Invalid
+// addresses are rejected before any fail mode is applied.
+func (h *Handler) evaluateAccess(clientIP string) (decision, error) {
 	addr, err := netip.ParseAddr(clientIP)
 	if err != nil {
-		return false, err
+		return decision{}, err
 	}
 
-	inList := h.matcher.Contains(addr)
+	mode := h.mode()
+
+	cause := h.failureCause()
+	if cause == "" {
+		return h.matchList(addr, mode), nil
+	}
+
+	failMode := h.policies.ForMode(mode).FailModeFor(cause)
+	metrics.FailModeDecisionsTotal.WithLabelValues(string(failMode), string(cause)).Inc()
+
+	d := decision{mode: mode, stale: cause == config.CauseEDLStale}
+	switch failMode {
+	case config.FailClosed:
+		d.reason = "fail_closed_" + string(cause)
+	case config.FailLastKnownGood:
+		if mode == "" || !h.hasLoadedEDL() {
+			d.reason = "fail_closed_" + string(cause)
+			break
+		}
+		listDecision := h.matchList(addr, mode)
+		d.allowed = listDecision.allowed
+		d.reason = "last_known_good_" + listDecision.reason
+	default:
+		d.allowed = true
+		d.reason = "fail_open_" + string(cause)
+	}
+	return d, nil
+}
+
+// matchList evaluates the client address against the loaded EDL. The mode
+// published with the list takes precedence over mode, so a list is never
+// judged with another list's mode while the mode is being switched.
+func (h *Handler) matchList(addr netip.Addr, mode string) decision {
+	inList, listMode := h.matcher.Lookup(addr)
+	if listMode != "" {
+		mode = listMode
+	}
 
 	// XOR operation: allowed if (blocklist AND NOT in list) OR (allowlist AND in list)
-	allowed := h.isBlocklist != inList
-	return allowed, nil
+	allowed := (mode == "blocklist") != inList
+
+	reason := "in_" + mode
+	if !inList {
+		reason = "not_in_" + mode
+	}
+
+	return decision{allowed: allowed, reason: reason, mode: mode}
+}
+
+// mode returns the current EDL mode, or "" if none was ever known. The
+// mode of the loaded list is preferred over the one set with SetMode.
+func (h *Handler) mode() string {
+	if mode := h.matcher.Mode(); mode != "" {
+		return mode
+	}
+	if !h.hasMode.Load() {
+		return ""
+	}
+	if h.isBlocklist.Load() {
+		return "blocklist"
+	}
+	return "allowlist"
+}
+
+// failureCause returns why the EDL cannot be enforced normally, or "" if
+// the deployment is active and the EDL is fresh
+func (h *Handler) failureCause() config.FailureCause {
+	switch config.DeploymentState(h.state.Load()) {
+	case config.DeploymentDisabled:
+		return config.CauseDeploymentDisabled
+	case config.DeploymentDeleted:
+		return config.CauseDeploymentDeleted
+	}
+
+	if h.updater != nil {
+		if _, stale := h.updater.Staleness(); stale {
+			return config.CauseEDLStale
+		}
+	}
+	return ""
+}
+
+func (h *Handler) hasLoadedEDL() bool {
+	return h.updater == nil || !h.updater.LastUpdate().IsZero()
+}
+
+// FailureStatus reports the failure cause currently in effect, the fail
+// mode applied to it and whether an EDL was ever loaded. The cause is ""
+// when the EDL is enforced normally.
+func (h *Handler) FailureStatus() (config.FailureCause, config.FailMode, bool) {
+	cause := h.failureCause()
+	if cause == "" {
+		return "", "", h.hasLoadedEDL()
+	}
+	return cause, h.policies.ForMode(h.mode()).FailModeFor(cause), h.hasLoadedEDL()
 }
 
 func (h *Handler) extractClientIP(r *http.Request) string {
@@ -163,14 +391,20 @@ func (h *Handler) extractClientIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
-func (h *Handler) sendAccessEvent(clientIP string, r *http.Request, allowed bool) {
-	edlMode := "blocklist"
-	if !h.isBlocklist {
-		edlMode = "allowlist"
+func (h *Handler) sendAccessEvent(clientIP string, r *http.Request, d decision, requestID string, at time.Time) {
+	edlMode := d.mode
+	if edlMode == "" {
+		edlMode = "unknown"
 	}
+	allowed := d.allowed
 
 	headers := make(map[string]string)
 	for key, values := range r.Header {
+		// The caller auth header carries the shared secret and must never
+		// leave the process
+		if h.callerAuth != nil && key == h.callerAuth.header {
+			continue
+		}
 		if len(values) > 0 {
 			headers[key] = values[0]
 		}
@@ -178,7 +412,11 @@ func (h *Handler) sendAccessEvent(clientIP string, r *http.Request, allowed bool
 
 	responseCode := http.StatusOK
 	if !allowed {
-		responseCode = http.StatusForbidden
+		policy := h.policies.ForMode(d.mode)
+		responseCode = policy.DenyStatusCode()
+		if redirectsDenial(r, policy) {
+			responseCode = policy.RedirectStatus
+		}
 	}
 
 	event := logs.NewAccessEvent(
@@ -189,6 +427,9 @@ func (h *Handler) sendAccessEvent(clientIP string, r *http.Request, allowed bool
 		allowed,
 		responseCode,
 	)
+	event.Reason = d.reason
+	event.RequestID = requestID
+	event.Timestamp = at
 
 	h.logShipper.SendEvent(event)
 }
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logs"
+	"go4.org/netipx"
+)
+
+// staticTokens is a TokenProvider for a stand-in logs endpoint
+type staticTokens struct{ url string }
+
+func (p staticTokens) GetTokenWithMinValidity(time.Duration) (string, error) { return "token", nil }
+func (p staticTokens) ForceRefresh() error                                   { return nil }
+func (p staticTokens) GetLogsURL() string                                    { return p.url }
+
+// logsServer collects the access events shipped to it
+type logsServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []logs.AccessEvent
+}
+
+func newLogsServer(t *testing.T) *logsServer {
+	s := &logsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = gz
+		}
+		decoder := json.NewDecoder(body)
+		for decoder.More() {
+			var event logs.AccessEvent
+			if err := decoder.Decode(&event); err != nil {
+				t.Error(err)
+				return
+			}
+			s.mu.Lock()
+			s.events = append(s.events, event)
+			s.mu.Unlock()
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// blockedMatcher returns a matcher containing addr
+func blockedMatcher(t *testing.T, addr string) *ipmatcher.Matcher {
+	t.Helper()
+	var builder netipx.IPSetBuilder
+	builder.Add(netip.MustParseAddr(addr))
+	set, err := builder.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := ipmatcher.New()
+	matcher.Update(set, 1)
+	return matcher
+}
+
+// deniedWithShipper serves one denied request with Accept: application/json
+// and returns the problem details and the shipped event
+func deniedWithShipper(t *testing.T, h *Handler, r *http.Request) (problem, logs.AccessEvent) {
+	t.Helper()
+
+	server := newLogsServer(t)
+	shipper := logs.NewLogShipper(staticTokens{url: server.URL}, &logs.LogShipperConfig{})
+	shipper.Start()
+	h.SetLogShipper(shipper)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shipper.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var p problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.events) != 1 {
+		t.Fatalf("shipped %d events, want 1", len(server.events))
+	}
+	return p, server.events[0]
+}
+
+func TestDeniedRequestIDShipped(t *testing.T) {
+	h := NewHandler(blockedMatcher(t, "192.0.2.1"), "blocklist", config.DeploymentActive)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	r.Header.Set("Accept", "application/json")
+
+	p, event := deniedWithShipper(t, h, r)
+	if p.RequestID == "" {
+		t.Fatal("problem has no request ID")
+	}
+	if event.RequestID != p.RequestID {
+		t.Errorf("event request_id = %q, want %q", event.RequestID, p.RequestID)
+	}
+	if ts := event.Timestamp.Format(time.RFC3339); ts != p.Timestamp {
+		t.Errorf("event ts = %s, want %s", ts, p.Timestamp)
+	}
+}
+
+func TestCallerSecretNotShipped(t *testing.T) {
+	const secret = "caller-secret-value"
+
+	server := newLogsServer(t)
+
+	h := NewHandler(blockedMatcher(t, "192.0.2.1"), "blocklist", config.DeploymentActive)
+	h.SetCallerAuth(NewCallerAuth("x-forwardauth-secret", secret, false))
+	shipper := logs.NewLogShipper(staticTokens{url: server.URL}, &logs.LogShipperConfig{})
+	shipper.Start()
+	h.SetLogShipper(shipper)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Forwardauth-Secret", secret)
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	r.Header.Set("X-Real-Ip", "192.0.2.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shipper.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.events) != 1 {
+		t.Fatalf("shipped %d events, want 1", len(server.events))
+	}
+	shipped, err := json.Marshal(server.events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(shipped, []byte(secret)) {
+		t.Errorf("shipped event contains the caller secret: %s", shipped)
+	}
+}
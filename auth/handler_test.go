@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/edl"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+func TestInvalidIPRejectedInFailMode(t *testing.T) {
+	for _, failMode := range []config.FailMode{config.FailOpen, config.FailClosed, config.FailLastKnownGood} {
+		t.Run(string(failMode), func(t *testing.T) {
+			h := NewHandler(ipmatcher.New(), "blocklist", config.DeploymentDisabled)
+			h.SetPolicies(config.Policies{Blocklist: config.Policy{FailMode: failMode}})
+
+			r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+			r.Header.Set("X-Forwarded-For", "not-an-ip")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestHiddenDenialRevealsNothing(t *testing.T) {
+	for _, tc := range []struct {
+		denyStatus int
+		wantStatus int
+		revealed   bool
+	}{
+		{denyStatus: http.StatusForbidden, wantStatus: http.StatusFound, revealed: true},
+		{denyStatus: http.StatusNotFound, wantStatus: http.StatusNotFound, revealed: false},
+	} {
+		t.Run(http.StatusText(tc.denyStatus), func(t *testing.T) {
+			// An EDL that was never loaded is stale, and fails closed here
+			h := NewHandler(ipmatcher.New(), "blocklist", config.DeploymentActive)
+			h.SetUpdater(edl.NewUpdater(&config.Config{}, ipmatcher.New()))
+			h.SetPolicies(config.Policies{Blocklist: config.Policy{
+				FailMode:       config.FailClosed,
+				DenyStatus:     tc.denyStatus,
+				RedirectURL:    "https://appeal.example.com/blocked",
+				RedirectStatus: http.StatusFound,
+			}})
+
+			r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+			r.Header.Set("X-Forwarded-Host", "app.example.com")
+			r.Header.Set("Accept", "text/html")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if got := w.Header().Get("Location") != ""; got != tc.revealed {
+				t.Errorf("redirected = %v, want %v", got, tc.revealed)
+			}
+			if got := w.Header().Get(staleHeader) != ""; got != tc.revealed {
+				t.Errorf("stale header set = %v, want %v", got, tc.revealed)
+			}
+		})
+	}
+}
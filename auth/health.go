@@ -3,40 +3,97 @@ package auth
 import (
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/edl"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logs"
 )
 
 type HealthHandler struct {
 	updater *edl.Updater
+	handler *Handler
+
+	// Optional components included in the health report when set
+	tokenManager *api.TokenManager
+	watcher      *config.Watcher
+	logShipper   *logs.LogShipper
+
+	// started latches once the startup probe has passed
+	started atomic.Bool
+	// shuttingDown fails readiness so traffic drains before shutdown
+	shuttingDown atomic.Bool
 }
 
-func NewHealthHandler(updater *edl.Updater) *HealthHandler {
+func NewHealthHandler(updater *edl.Updater, handler *Handler) *HealthHandler {
 	return &HealthHandler{
 		updater: updater,
+		handler: handler,
 	}
 }
 
+// SetShuttingDown makes readiness fail from now on, so load balancers stop
+// routing new requests before the server shuts down
+func (h *HealthHandler) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+func (h *HealthHandler) SetTokenManager(tm *api.TokenManager) {
+	h.tokenManager = tm
+}
+
+func (h *HealthHandler) SetConfigWatcher(watcher *config.Watcher) {
+	h.watcher = watcher
+}
+
+func (h *HealthHandler) SetLogShipper(shipper *logs.LogShipper) {
+	h.logShipper = shipper
+}
+
+// healthStatusHeader carries the overall status of /health responses, so
+// checks that only look at headers can tell degraded from ok
+const healthStatusHeader = "X-Health-Status"
+
+// Health reports the status of each component and an overall status.
+// Degraded responses keep 200 so plain HTTP checks keep passing, with the
+// degradation visible in the X-Health-Status header and the body; failing
+// responses use 503.
 func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 	lastUpdate, lastError, updateCount, entryCount := h.updater.GetStatus()
+	_, stale := h.updater.Staleness()
+	overall, components := h.checkComponents()
 
 	status := map[string]interface{}{
-		"status":                   "healthy",
+		"status":                   overall,
+		"components":               components,
 		"version":                  getVersion(),
 		"git_commit":               getGitCommit(),
 		"build_date":               getBuildDate(),
 		"last_update":              lastUpdate.Format(time.RFC3339),
 		"update_count":             updateCount,
 		"entry_count":              entryCount,
-		"uptime_since_last_update": time.Since(lastUpdate).Seconds(),
+		"uptime_since_last_update": nil,
+		"stale":                    stale,
+		"max_age_seconds":          h.updater.MaxAge().Seconds(),
 	}
 
+	if !lastUpdate.IsZero() {
+		status["uptime_since_last_update"] = time.Since(lastUpdate).Seconds()
+	}
 	if lastError != nil {
 		status["last_error"] = lastError.Error()
 	}
 
+	code := http.StatusOK
+	if overall == StatusFailing {
+		code = http.StatusServiceUnavailable
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(healthStatusHeader, string(overall))
+	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(status); err != nil {
 		// Log error but response is already being written
 		_ = err
@@ -44,20 +101,28 @@ func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
-	lastUpdate, _, _, entryCount := h.updater.GetStatus()
-
-	if lastUpdate.IsZero() || entryCount == 0 {
+	if h.shuttingDown.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		if _, err := w.Write([]byte("Not ready - EDL not yet loaded")); err != nil {
+		if _, err := w.Write([]byte("Not ready - shutting down")); err != nil {
 			// Log error but response is already being written
 			_ = err
 		}
 		return
 	}
 
-	if time.Since(lastUpdate) > 2*time.Hour {
+	// While a fail mode is in effect, readiness reports how decisions
+	// are being made instead of the EDL checks below
+	if cause, failMode, hasEDL := h.handler.FailureStatus(); cause != "" {
+		h.failModeReady(w, cause, failMode, hasEDL)
+		return
+	}
+
+	lastUpdate, _, _, _ := h.updater.GetStatus()
+
+	// An empty EDL is valid once loaded, e.g. a blocklist with no entries
+	if lastUpdate.IsZero() {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		if _, err := w.Write([]byte("Not ready - EDL data is stale")); err != nil {
+		if _, err := w.Write([]byte("Not ready - EDL not yet loaded")); err != nil {
 			// Log error but response is already being written
 			_ = err
 		}
@@ -70,3 +135,33 @@ func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
 		_ = err
 	}
 }
+
+// failModeReady answers readiness while a fail mode is in effect. Failing
+// open or closed is a deliberate, configured behavior and reports ready;
+// serving a last known good EDL reports not ready, as stale data always has.
+func (h *HealthHandler) failModeReady(w http.ResponseWriter, cause config.FailureCause, failMode config.FailMode, hasEDL bool) {
+	w.Header().Set("X-Forwardauth-Fail-Mode", string(failMode))
+
+	status := http.StatusOK
+	var message string
+
+	switch failMode {
+	case config.FailClosed:
+		message = "Ready - failing closed (" + string(cause) + ")"
+	case config.FailLastKnownGood:
+		status = http.StatusServiceUnavailable
+		if hasEDL {
+			message = "Not ready - serving last known good EDL (" + string(cause) + ")"
+		} else {
+			message = "Not ready - no EDL loaded, failing closed (" + string(cause) + ")"
+		}
+	default:
+		message = "Ready - failing open (" + string(cause) + ")"
+	}
+
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(message)); err != nil {
+		// Log error but response is already being written
+		_ = err
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/edl"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+func TestHealthStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    config.DeploymentState
+		pollFail bool
+		want     ComponentStatus
+		code     int
+	}{
+		// A disabled deployment needs no EDL
+		{"ok", config.DeploymentDisabled, false, StatusOK, http.StatusOK},
+		{"degraded", config.DeploymentDisabled, true, StatusDegraded, http.StatusOK},
+		// An active deployment without a loaded EDL
+		{"failing", config.DeploymentActive, false, StatusFailing, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			matcher := ipmatcher.New()
+			h := NewHealthHandler(edl.NewUpdater(cfg, matcher), NewHandler(matcher, "blocklist", tt.state))
+			if tt.pollFail {
+				// Without a config client every poll fails
+				watcher := config.NewWatcher(cfg)
+				_ = watcher.CheckNow(context.Background())
+				h.SetConfigWatcher(watcher)
+			}
+
+			w := httptest.NewRecorder()
+			h.Health(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			if w.Code != tt.code {
+				t.Errorf("status code = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get(healthStatusHeader); got != string(tt.want) {
+				t.Errorf("%s = %q, want %q", healthStatusHeader, got, tt.want)
+			}
+
+			var body map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body["status"] != string(tt.want) {
+				t.Errorf("status = %v, want %s", body["status"], tt.want)
+			}
+			// No EDL was ever loaded
+			if uptime, ok := body["uptime_since_last_update"]; !ok || uptime != nil {
+				t.Errorf("uptime_since_last_update = %v, want null", uptime)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+)
+
+// probeCheck is a single named check of a Kubernetes-style probe. A nil
+// error passes the check; the message is shown in verbose output.
+type probeCheck struct {
+	name  string
+	check func() (string, error)
+}
+
+// Livez reports whether the process is alive. It only fails if the server
+// cannot answer at all, so a slow platform never triggers a restart.
+func (h *HealthHandler) Livez(w http.ResponseWriter, r *http.Request) {
+	serveProbe(w, r, "livez", []probeCheck{
+		{name: "ping", check: func() (string, error) { return "", nil }},
+	})
+}
+
+// Startupz reports whether initialization has finished: an EDL was loaded,
+// or the deployment is not active and no EDL is expected. Once passed it
+// stays passed, as Kubernetes stops calling it anyway.
+func (h *HealthHandler) Startupz(w http.ResponseWriter, r *http.Request) {
+	if h.started.Load() {
+		serveProbe(w, r, "startupz", []probeCheck{
+			{name: "initial_edl", check: func() (string, error) { return "startup complete", nil }},
+		})
+		return
+	}
+
+	passed := serveProbe(w, r, "startupz", []probeCheck{
+		{name: "initial_edl", check: h.checkInitialEDL},
+	})
+	if passed {
+		h.started.Store(true)
+	}
+}
+
+// Readyz reports whether decisions can be served. Unlike Ready, an empty
+// EDL, a disabled deployment and a last known good EDL served from memory
+// are all ready; only an active deployment that never loaded an EDL and
+// has no explicit fail mode is not.
+func (h *HealthHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	serveProbe(w, r, "readyz", []probeCheck{
+		{name: "shutdown", check: h.checkShutdown},
+		{name: "edl", check: h.checkReadyEDL},
+	})
+}
+
+func (h *HealthHandler) checkShutdown() (string, error) {
+	if h.shuttingDown.Load() {
+		return "", errors.New("shutting down")
+	}
+	return "", nil
+}
+
+func (h *HealthHandler) checkInitialEDL() (string, error) {
+	cause, _, hasEDL := h.handler.FailureStatus()
+	switch {
+	case cause == config.CauseDeploymentDisabled || cause == config.CauseDeploymentDeleted:
+		return "no EDL expected (" + string(cause) + ")", nil
+	case hasEDL:
+		return "EDL loaded", nil
+	default:
+		return "", errors.New("EDL not yet loaded")
+	}
+}
+
+func (h *HealthHandler) checkReadyEDL() (string, error) {
+	cause, failMode, hasEDL := h.handler.FailureStatus()
+	switch {
+	case cause == "":
+		return "EDL enforced", nil
+	case cause == config.CauseDeploymentDisabled || cause == config.CauseDeploymentDeleted:
+		return "failing " + string(failMode) + " (" + string(cause) + ")", nil
+	case hasEDL:
+		return "serving last known good EDL (" + string(cause) + ")", nil
+	case failMode != config.FailLastKnownGood:
+		return "failing " + string(failMode) + " (" + string(cause) + ")", nil
+	default:
+		return "", errors.New("EDL not yet loaded")
+	}
+}
+
+// serveProbe runs checks and writes the result in the format used by the
+// Kubernetes API server: "ok", or one line per check with ?verbose or on
+// failure. It reports whether all checks passed.
+func serveProbe(w http.ResponseWriter, r *http.Request, name string, checks []probeCheck) bool {
+	var out strings.Builder
+	passed := true
+
+	for _, c := range checks {
+		message, err := c.check()
+		if err != nil {
+			passed = false
+			out.WriteString("[-]" + c.name + " failed: " + err.Error() + "\n")
+			continue
+		}
+		out.WriteString("[+]" + c.name + " ok")
+		if message != "" {
+			out.WriteString(" (" + message + ")")
+		}
+		out.WriteString("\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if !passed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		out.WriteString(name + " check failed\n")
+		_, _ = w.Write([]byte(out.String()))
+		return false
+	}
+
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		out.WriteString(name + " check passed\n")
+		_, _ = w.Write([]byte(out.String()))
+		return true
+	}
+
+	_, _ = w.Write([]byte("ok"))
+	return true
+}
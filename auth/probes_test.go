@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/edl"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+// newProbeHandler returns a health handler for a blocklist deployment in
+// state. With list set, the EDL is loaded from a stand-in server first.
+func newProbeHandler(t *testing.T, state config.DeploymentState, list *string) *HealthHandler {
+	t.Helper()
+
+	cfg := &config.Config{
+		DeploymentEnabled: state.IsActive(),
+		EDLMode:           "blocklist",
+		UpdateFrequency:   time.Minute,
+		EDLMaxAgeFactor:   24,
+		MaxRetryAttempts:  1,
+		RetryDelay:        time.Millisecond,
+	}
+	if list != nil {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(*list))
+		}))
+		t.Cleanup(ts.Close)
+		cfg.EDLURL = ts.URL
+	}
+
+	matcher := ipmatcher.New()
+	updater := edl.NewUpdater(cfg, matcher)
+	if list != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		if err := updater.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := NewHandler(matcher, "blocklist", state)
+	handler.SetUpdater(updater)
+	return NewHealthHandler(updater, handler)
+}
+
+func probe(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestProbes(t *testing.T) {
+	empty := ""
+	failOpen := config.Policies{Blocklist: config.Policy{FailMode: config.FailOpen}}
+
+	tests := []struct {
+		name     string
+		state    config.DeploymentState
+		list     *string
+		policies *config.Policies
+		ready    int
+		started  int
+	}{
+		{"never loaded", config.DeploymentActive, nil, nil, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"never loaded, fail open", config.DeploymentActive, nil, &failOpen, http.StatusOK, http.StatusServiceUnavailable},
+		{"empty list", config.DeploymentActive, &empty, nil, http.StatusOK, http.StatusOK},
+		{"disabled", config.DeploymentDisabled, nil, nil, http.StatusOK, http.StatusOK},
+		{"deleted", config.DeploymentDeleted, nil, nil, http.StatusOK, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newProbeHandler(t, tt.state, tt.list)
+			if tt.policies != nil {
+				h.handler.SetPolicies(*tt.policies)
+			}
+
+			if w := probe(h.Livez, "/livez"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+				t.Errorf("livez = %d %q, want 200 ok", w.Code, w.Body.String())
+			}
+			if w := probe(h.Readyz, "/readyz"); w.Code != tt.ready {
+				t.Errorf("readyz = %d, want %d:\n%s", w.Code, tt.ready, w.Body.String())
+			}
+			if w := probe(h.Startupz, "/startupz"); w.Code != tt.started {
+				t.Errorf("startupz = %d, want %d:\n%s", w.Code, tt.started, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestReadyzFailsWhileShuttingDown(t *testing.T) {
+	h := newProbeHandler(t, config.DeploymentDisabled, nil)
+	h.SetShuttingDown()
+
+	w := probe(h.Readyz, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz = %d, want 503", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "[-]shutdown failed") || !strings.Contains(body, "[+]edl ok") {
+		t.Errorf("readyz body = %q", body)
+	}
+}
+
+func TestProbeVerboseListsChecks(t *testing.T) {
+	h := newProbeHandler(t, config.DeploymentDisabled, nil)
+
+	w := probe(h.Readyz, "/readyz?verbose")
+	want := "[+]shutdown ok\n[+]edl ok (failing open (deployment_disabled))\nreadyz check passed\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("readyz?verbose = %d %q, want 200 %q", w.Code, w.Body.String(), want)
+	}
+}
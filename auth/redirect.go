@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// reasonTokenIssuer identifies reason tokens minted by ForwardAuth
+	reasonTokenIssuer = "ellio-forwardauth"
+	// reasonTokenTTL is how long a landing page may accept a reason token
+	reasonTokenTTL = 1 * time.Hour
+)
+
+// reasonClaims are the claims of the signed reason token passed to the
+// redirect target, so it can trust why and for whom access was denied
+type reasonClaims struct {
+	Reason string `json:"reason"`
+	Host   string `json:"host,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// redirectsDenial reports whether a denied request is redirected rather
+// than answered directly. Only browsers are redirected, and never when the
+// deny status hides the denial.
+func redirectsDenial(r *http.Request, policy config.Policy) bool {
+	return policy.RedirectURL != "" && !policy.HidesDenial() &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// redirectURL builds the redirect target for a denied request from the
+// policy's URL template, adding the original host and URI and, when a
+// secret is set, a signed reason token as query parameters
+func (h *Handler) redirectURL(r *http.Request, policy config.Policy, clientIP, requestID string, at time.Time, d decision) (string, error) {
+	host := r.Header.Get("X-Forwarded-Host")
+	// The host is client-controlled; anything that could change the
+	// structure of the target is dropped
+	if strings.ContainsAny(host, "/\\?#@ ") {
+		host = ""
+	}
+
+	// The template was validated at startup. The authority is fixed there,
+	// so {host} can only be replaced in the path, query and fragment.
+	target, err := url.Parse(policy.RedirectURL)
+	if err != nil {
+		return "", err
+	}
+	target.Path = strings.ReplaceAll(target.Path, "{host}", host)
+	target.RawPath = ""
+	target.RawQuery = strings.ReplaceAll(target.RawQuery, "{host}", url.QueryEscape(host))
+	target.Fragment = strings.ReplaceAll(target.Fragment, "{host}", host)
+	target.RawFragment = ""
+
+	query := target.Query()
+	if host != "" {
+		query.Set("host", host)
+	}
+	if uri := r.Header.Get("X-Forwarded-Uri"); uri != "" {
+		query.Set("uri", uri)
+	}
+
+	if len(h.redirectSecret) > 0 {
+		claims := reasonClaims{
+			Reason: d.reason,
+			Host:   host,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    reasonTokenIssuer,
+				Subject:   clientIP,
+				ID:        requestID,
+				IssuedAt:  jwt.NewNumericDate(at),
+				ExpiresAt: jwt.NewNumericDate(at.Add(reasonTokenTTL)),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(h.redirectSecret)
+		if err != nil {
+			return "", err
+		}
+		query.Set("token", token)
+	}
+
+	target.RawQuery = query.Encode()
+	return target.String(), nil
+}
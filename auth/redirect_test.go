@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+)
+
+func TestRedirectHostOnlyInPathAndQuery(t *testing.T) {
+	h := NewHandler(nil, "blocklist", config.DeploymentActive)
+	h.SetRedirectSecret([]byte("secret"))
+	policy := config.Policy{RedirectURL: "https://appeal.example.com/{host}/blocked?site={host}"}
+
+	for _, host := range []string{"app.example.com", "evil.example.net", "evil.example.net/x", "a@evil.example.net"} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Forwarded-Host", host)
+
+		target, err := h.redirectURL(r, policy, "192.0.2.1", "id", time.Now(), decision{reason: "in_blocklist"})
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		if u.Host != "appeal.example.com" {
+			t.Errorf("%s: redirected to host %q", host, u.Host)
+		}
+		if u.Query().Get("token") == "" {
+			t.Errorf("%s: no reason token", host)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	target, err := h.redirectURL(r, policy, "192.0.2.1", "id", time.Now(), decision{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(target)
+	if u.Path != "/app.example.com/blocked" || u.Query().Get("site") != "app.example.com" {
+		t.Errorf("host not substituted: %s", target)
+	}
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+)
+
+// readBootstrapFile reads the bootstrap token from a secret file, as
+// mounted by Docker or Kubernetes secrets
+func readBootstrapFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("bootstrap token file is empty")
+	}
+	return token, nil
+}
+
+// WatchBootstrapFile polls the bootstrap token file and hands a rotated
+// token to the token manager. Polling also follows the symlink swaps
+// Kubernetes uses to update mounted secrets. A token that fails to
+// bootstrap is retried on the next poll while the old one stays in use.
+func (cfg *Config) WatchBootstrapFile(ctx context.Context) {
+	if cfg.BootstrapTokenFile == "" || cfg.BootstrapFilePollInterval <= 0 || cfg.TokenManager == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.BootstrapFilePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cfg.reloadBootstrapFile(ctx)
+			}
+		}
+	}()
+}
+
+func (cfg *Config) reloadBootstrapFile(ctx context.Context) {
+	token, err := readBootstrapFile(cfg.BootstrapTokenFile)
+	if err != nil {
+		logger.Warn("Failed to read bootstrap token file", "path", cfg.BootstrapTokenFile, "error", err)
+		return
+	}
+
+	if token == cfg.TokenManager.BootstrapToken() {
+		return
+	}
+
+	fingerprint := api.TokenFingerprint(token)
+	logger.Info("Bootstrap token file changed", "fingerprint", fingerprint)
+
+	if err := cfg.TokenManager.SetBootstrapToken(ctx, token); err != nil {
+		logger.Error("Failed to bootstrap with rotated token, keeping current token",
+			"fingerprint", fingerprint,
+			"error", err)
+		return
+	}
+
+	cfg.mu.Lock()
+	cfg.BootstrapToken = token
+	cfg.mu.Unlock()
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+)
+
+func TestFailedBootstrapFileRotationKeepsToken(t *testing.T) {
+	const current = "current-token"
+	path := filepath.Join(t.TempDir(), "bootstrap")
+
+	cfg := newTestConfig()
+	cfg.BootstrapToken = current
+	cfg.BootstrapTokenFile = path
+	cfg.TokenManager = api.NewTokenManager(current, []string{api.ScopeConfig})
+
+	for _, content := range []string{"", "not-a-token\n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg.reloadBootstrapFile(context.Background())
+
+		if cfg.BootstrapToken != current {
+			t.Errorf("config token after %q = %q, want %q", content, cfg.BootstrapToken, current)
+		}
+		if got := cfg.TokenManager.BootstrapToken(); got != current {
+			t.Errorf("token manager token after %q = %q, want %q", content, got, current)
+		}
+	}
+}
@@ -2,6 +2,10 @@ package config
 
 import (
 	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
@@ -10,6 +14,7 @@ import (
 type Config struct {
 	BootstrapToken    string
 	EDLURL            string
+	EDLDeltaURL       string
 	EDLMode           string
 	UpdateFrequency   time.Duration
 	Port              string
@@ -21,6 +26,7 @@ type Config struct {
 	ConfigClient      *api.ConfigClient
 	DeploymentEnabled bool
 	// Log shipping configuration
+	LogShippingEnabled    bool
 	LogBatchSize          int
 	LogFlushInterval      time.Duration
 	LeakyBucketCapacity   int64
@@ -29,6 +35,144 @@ type Config struct {
 	DeviceID              string
 	// IP extraction configuration
 	IPHeaderOverride string
+	// EDL sync configuration
+	FullResyncInterval time.Duration
+	EDLEventsURL       string
+	EDLWebhookSecret   string
+	UpdateJitter       float64
+	MaxUpdateBackoff   time.Duration
+	// EDLMaxAge is a fixed staleness threshold; when zero the threshold is
+	// EDLMaxAgeFactor times the update frequency
+	EDLMaxAge       time.Duration
+	EDLMaxAgeFactor float64
+	// Config polling configuration
+	ConfigPollInterval      time.Duration
+	DeploymentProbeInterval time.Duration
+	// Policy configuration
+	Policies Policies
+	// Bootstrap token file configuration
+	BootstrapTokenFile        string
+	BootstrapFilePollInterval time.Duration
+	// TokenCacheFile persists the access token across restarts when set
+	TokenCacheFile string
+	// Probe configuration
+	ProbesOnMetricsPort bool
+	// Shutdown configuration
+	ShutdownDrainPeriod time.Duration
+	ShutdownTimeout     time.Duration
+	// TLS configuration; the auth and metrics servers use plain HTTP when
+	// their certificate is not set
+	TLSCertFile            string
+	TLSKeyFile             string
+	TLSClientCAFile        string
+	MetricsTLSCertFile     string
+	MetricsTLSKeyFile      string
+	MetricsTLSClientCAFile string
+	TLSReloadInterval      time.Duration
+	// Caller authentication; when AuthSecret is set, auth requests must
+	// carry it in AuthSecretHeader, or an HMAC of it when AuthSecretMode
+	// is "hmac"
+	AuthSecret       string
+	AuthSecretHeader string
+	AuthSecretMode   string
+	// Listen addresses; empty binds to all interfaces, and "unix:/path"
+	// listens on a Unix domain socket created with SocketMode
+	ListenAddress        string
+	MetricsListenAddress string
+	SocketMode           os.FileMode
+	// Metrics server protection
+	MetricsAuthUsername string
+	MetricsAuthPassword string
+	MetricsAuthToken    string
+	PprofEnabled        bool
+
+	// Block page
+	BlockPageDir            string
+	BlockPageReloadInterval time.Duration
+	SupportContact          string
+
+	// Denial redirects
+	DenyRedirectSecret string
+
+	// Platform trust anchors
+	PlatformIssuer  string
+	PlatformJWKSURL string
+
+	// mu guards the platform-controlled EDL fields, which may be changed
+	// at runtime by the Watcher, and BootstrapToken, which may be rotated
+	// through the token file
+	mu               sync.RWMutex
+	eventsURLFromEnv bool
+}
+
+// ListenAddr returns the address the auth server listens on
+func (cfg *Config) ListenAddr() string {
+	return listenAddr(cfg.ListenAddress, cfg.Port)
+}
+
+// MetricsListenAddr returns the address the metrics server listens on
+func (cfg *Config) MetricsListenAddr() string {
+	return listenAddr(cfg.MetricsListenAddress, cfg.MetricsPort)
+}
+
+func listenAddr(address, port string) string {
+	if strings.HasPrefix(address, "unix:") {
+		return address
+	}
+	return net.JoinHostPort(address, port)
+}
+
+// GetBootstrapToken returns the bootstrap token currently in use, which
+// may be rotated at runtime through the token file
+func (cfg *Config) GetBootstrapToken() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.BootstrapToken
+}
+
+// EDLSettings is a snapshot of the platform-controlled EDL settings
+type EDLSettings struct {
+	Enabled         bool
+	Mode            string
+	URL             string
+	DeltaURL        string
+	EventsURL       string
+	UpdateFrequency time.Duration
+}
+
+// EDLSettings returns a consistent snapshot of the current EDL settings.
+// Code running after startup must use this instead of reading the fields.
+func (cfg *Config) EDLSettings() EDLSettings {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return EDLSettings{
+		Enabled:         cfg.DeploymentEnabled,
+		Mode:            cfg.EDLMode,
+		URL:             cfg.EDLURL,
+		DeltaURL:        cfg.EDLDeltaURL,
+		EventsURL:       cfg.EDLEventsURL,
+		UpdateFrequency: cfg.UpdateFrequency,
+	}
+}
+
+// setEDLSettings replaces the EDL settings with settings
+func (cfg *Config) setEDLSettings(settings EDLSettings) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.DeploymentEnabled = settings.Enabled
+	cfg.EDLMode = settings.Mode
+	cfg.EDLURL = settings.URL
+	cfg.EDLDeltaURL = settings.DeltaURL
+	cfg.EDLEventsURL = settings.EventsURL
+	cfg.UpdateFrequency = settings.UpdateFrequency
+}
+
+// MaxEDLAge returns how old the loaded EDL may get before it is stale
+func (cfg *Config) MaxEDLAge() time.Duration {
+	if cfg.EDLMaxAge > 0 {
+		return cfg.EDLMaxAge
+	}
+	return time.Duration(float64(cfg.EDLSettings().UpdateFrequency) * cfg.EDLMaxAgeFactor)
 }
 
 // Load loads configuration and initializes services
@@ -45,3 +189,12 @@ func Load() (*Config, error) {
 
 	return cfg, nil
 }
+
+// Scopes returns the platform scopes needed by the enabled features
+func (cfg *Config) Scopes() []string {
+	scopes := []string{api.ScopeConfig}
+	if cfg.LogShippingEnabled {
+		scopes = append(scopes, api.ScopeLogs)
+	}
+	return scopes
+}
@@ -38,7 +38,7 @@ func (s DeploymentState) String() string {
 
 // GetDeploymentState determines the deployment state based on configuration
 func (cfg *Config) GetDeploymentState() DeploymentState {
-	if !cfg.DeploymentEnabled {
+	if !cfg.EDLSettings().Enabled {
 		if cfg.TokenManager != nil && cfg.TokenManager.IsDeploymentDeleted() {
 			return DeploymentDeleted
 		}
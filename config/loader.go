@@ -3,9 +3,12 @@ package config
 import (
 	"context"
 	"errors"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/keygen-sh/machineid"
@@ -13,26 +16,108 @@ import (
 
 // LoadFromEnv loads configuration from environment variables only
 func LoadFromEnv() *Config {
-	return &Config{
-		BootstrapToken:        utils.GetEnv("ELLIO_BOOTSTRAP", ""),
-		Port:                  utils.GetEnv("PORT", "8080"),
-		MetricsPort:           utils.GetEnv("METRICS_PORT", "9090"),
-		LogLevel:              utils.GetEnv("LOG_LEVEL", "info"),
-		MaxRetryAttempts:      utils.GetEnvAsInt("MAX_RETRY_ATTEMPTS", 3),
-		LogBatchSize:          utils.GetEnvAsInt("LOG_BATCH_SIZE", 100),
-		LeakyBucketCapacity:   utils.GetEnvAsInt64("LEAKY_BUCKET_CAPACITY", 1000),
-		LeakyBucketRefillRate: utils.GetEnvAsInt64("LEAKY_BUCKET_REFILL_RATE", 100),
-		LogBufferSize:         utils.GetEnvAsInt("LOG_BUFFER_SIZE", 10000),
-		IPHeaderOverride:      utils.GetEnv("IP_HEADER_OVERRIDE", ""),
-		RetryDelay:            utils.GetEnvAsDuration("RETRY_DELAY", 30*time.Second),
-		LogFlushInterval:      utils.GetEnvAsDuration("LOG_FLUSH_INTERVAL", 10*time.Second),
+	cfg := &Config{
+		BootstrapToken:            utils.GetEnv("ELLIO_BOOTSTRAP", ""),
+		Port:                      utils.GetEnv("PORT", "8080"),
+		MetricsPort:               utils.GetEnv("METRICS_PORT", "9090"),
+		LogLevel:                  utils.GetEnv("LOG_LEVEL", "info"),
+		MaxRetryAttempts:          utils.GetEnvAsInt("MAX_RETRY_ATTEMPTS", 3),
+		LogShippingEnabled:        utils.GetEnvAsBool("LOG_SHIPPING_ENABLED", true),
+		LogBatchSize:              utils.GetEnvAsInt("LOG_BATCH_SIZE", 100),
+		LeakyBucketCapacity:       utils.GetEnvAsInt64("LEAKY_BUCKET_CAPACITY", 1000),
+		LeakyBucketRefillRate:     utils.GetEnvAsInt64("LEAKY_BUCKET_REFILL_RATE", 100),
+		LogBufferSize:             utils.GetEnvAsInt("LOG_BUFFER_SIZE", 10000),
+		IPHeaderOverride:          utils.GetEnv("IP_HEADER_OVERRIDE", ""),
+		RetryDelay:                utils.GetEnvAsDuration("RETRY_DELAY", 30*time.Second),
+		LogFlushInterval:          utils.GetEnvAsDuration("LOG_FLUSH_INTERVAL", 10*time.Second),
+		FullResyncInterval:        utils.GetEnvAsDuration("EDL_FULL_RESYNC_INTERVAL", 1*time.Hour),
+		EDLEventsURL:              utils.GetEnv("EDL_EVENTS_URL", ""),
+		EDLWebhookSecret:          utils.GetEnv("EDL_WEBHOOK_SECRET", ""),
+		UpdateJitter:              utils.GetEnvAsFloat("EDL_UPDATE_JITTER", 0.1),
+		MaxUpdateBackoff:          utils.GetEnvAsDuration("EDL_MAX_UPDATE_BACKOFF", 30*time.Minute),
+		ConfigPollInterval:        utils.GetEnvAsDuration("CONFIG_POLL_INTERVAL", 5*time.Minute),
+		DeploymentProbeInterval:   utils.GetEnvAsDuration("DEPLOYMENT_PROBE_INTERVAL", 1*time.Minute),
+		BootstrapTokenFile:        utils.GetEnv("ELLIO_BOOTSTRAP_FILE", ""),
+		BootstrapFilePollInterval: utils.GetEnvAsDuration("ELLIO_BOOTSTRAP_FILE_POLL_INTERVAL", 30*time.Second),
+		TokenCacheFile:            utils.GetEnv("TOKEN_CACHE_FILE", ""),
+		PlatformIssuer:            utils.GetEnv("PLATFORM_ISSUER", ""),
+		PlatformJWKSURL:           utils.GetEnv("PLATFORM_JWKS_URL", ""),
+		ProbesOnMetricsPort:       utils.GetEnvAsBool("PROBES_ON_METRICS_PORT", false),
+		ShutdownDrainPeriod:       utils.GetEnvAsDuration("SHUTDOWN_DRAIN_PERIOD", 5*time.Second),
+		ShutdownTimeout:           utils.GetEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		TLSCertFile:               utils.GetEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:                utils.GetEnv("TLS_KEY_FILE", ""),
+		TLSClientCAFile:           utils.GetEnv("TLS_CLIENT_CA_FILE", ""),
+		MetricsTLSCertFile:        utils.GetEnv("METRICS_TLS_CERT_FILE", ""),
+		MetricsTLSKeyFile:         utils.GetEnv("METRICS_TLS_KEY_FILE", ""),
+		MetricsTLSClientCAFile:    utils.GetEnv("METRICS_TLS_CLIENT_CA_FILE", ""),
+		TLSReloadInterval:         utils.GetEnvAsDuration("TLS_RELOAD_INTERVAL", 1*time.Minute),
+		AuthSecret:                utils.GetEnv("AUTH_SECRET", ""),
+		AuthSecretHeader:          utils.GetEnv("AUTH_SECRET_HEADER", "X-Forwardauth-Secret"),
+		AuthSecretMode:            parseAuthSecretMode(),
+		ListenAddress:             utils.GetEnv("LISTEN_ADDRESS", ""),
+		MetricsListenAddress:      utils.GetEnv("METRICS_LISTEN_ADDRESS", ""),
+		SocketMode:                parseSocketMode(),
+		MetricsAuthUsername:       utils.GetEnv("METRICS_AUTH_USERNAME", ""),
+		MetricsAuthPassword:       utils.GetEnv("METRICS_AUTH_PASSWORD", ""),
+		MetricsAuthToken:          utils.GetEnv("METRICS_AUTH_TOKEN", ""),
+		PprofEnabled:              utils.GetEnvAsBool("PPROF_ENABLED", false),
+		BlockPageDir:              utils.GetEnv("BLOCK_PAGE_DIR", "/static"),
+		BlockPageReloadInterval:   utils.GetEnvAsDuration("BLOCK_PAGE_RELOAD_INTERVAL", 1*time.Minute),
+		SupportContact:            utils.GetEnv("SUPPORT_CONTACT", ""),
+		DenyRedirectSecret:        utils.GetEnv("DENY_REDIRECT_SECRET", ""),
+		Policies:                  loadPolicies(),
+
+		// A factor of 24 keeps the former fixed 2h threshold for the
+		// platform's default 5 minute update frequency
+		EDLMaxAge:       utils.GetEnvAsDuration("EDL_MAX_AGE", 0),
+		EDLMaxAgeFactor: utils.GetEnvAsFloat("EDL_MAX_AGE_FACTOR", 24),
+	}
+	cfg.eventsURLFromEnv = cfg.EDLEventsURL != ""
+
+	return cfg
+}
+
+func parseAuthSecretMode() string {
+	mode := utils.GetEnv("AUTH_SECRET_MODE", "token")
+	if mode != "token" && mode != "hmac" {
+		logger.Warn("Ignoring invalid AUTH_SECRET_MODE", "value", mode)
+		return "token"
+	}
+	return mode
+}
+
+// parseSocketMode reads SOCKET_MODE as an octal permission mode
+func parseSocketMode() os.FileMode {
+	mode := utils.GetEnv("SOCKET_MODE", "")
+	if mode == "" {
+		return 0660
 	}
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		logger.Warn("Ignoring invalid SOCKET_MODE", "value", mode)
+		return 0660
+	}
+	return os.FileMode(parsed)
 }
 
 // InitializeServices initializes external services and fetches EDL configuration
 func (cfg *Config) InitializeServices(ctx context.Context) error {
-	if cfg.BootstrapToken == "" {
-		return errors.New("ELLIO_BOOTSTRAP token is required")
+	// A token file takes precedence, so secrets don't have to be exposed
+	// in the environment
+	if cfg.BootstrapTokenFile != "" {
+		token, err := readBootstrapFile(cfg.BootstrapTokenFile)
+		if err != nil {
+			return errors.New("failed to read ELLIO_BOOTSTRAP_FILE: " + err.Error())
+		}
+		cfg.mu.Lock()
+		cfg.BootstrapToken = token
+		cfg.mu.Unlock()
+	}
+
+	bootstrapToken := cfg.GetBootstrapToken()
+	if bootstrapToken == "" {
+		return errors.New("ELLIO_BOOTSTRAP or ELLIO_BOOTSTRAP_FILE is required")
 	}
 
 	// Parse bootstrap token to get deployment ID
@@ -40,12 +125,24 @@ func (cfg *Config) InitializeServices(ctx context.Context) error {
 		return err
 	}
 
-	// Initialize token manager
-	cfg.TokenManager = api.NewTokenManager(cfg.BootstrapToken)
+	// Initialize token manager and config client
+	cfg.TokenManager = api.NewTokenManager(bootstrapToken, cfg.Scopes())
+	if cfg.TokenCacheFile != "" {
+		cfg.TokenManager.EnableCache(cfg.TokenCacheFile)
+	}
+	if cfg.PlatformIssuer != "" || cfg.PlatformJWKSURL != "" {
+		cfg.TokenManager.PinPlatform(cfg.PlatformIssuer, cfg.PlatformJWKSURL)
+	} else {
+		logger.Warn("Platform issuer and JWKS are not pinned, trusting the bootstrap token's issuer; set PLATFORM_ISSUER and PLATFORM_JWKS_URL")
+	}
+	cfg.ConfigClient = api.NewConfigClient(cfg.TokenManager)
 
 	// Bootstrap and get initial token
 	if err := cfg.TokenManager.Initialize(ctx); err != nil {
 		if api.IsPermanentError(err) {
+			// The refresh loop stays idle until the Watcher finds the
+			// deployment restored
+			cfg.TokenManager.StartRefreshLoop(context.Background())
 			cfg.setDeploymentDisabled()
 			return nil
 		}
@@ -55,16 +152,25 @@ func (cfg *Config) InitializeServices(ctx context.Context) error {
 	// Start token refresh loop
 	cfg.TokenManager.StartRefreshLoop(context.Background())
 
-	// Create config client and fetch EDL configuration
-	cfg.ConfigClient = api.NewConfigClient(cfg.TokenManager)
+	if !cfg.TokenManager.HasScope(api.ScopeConfig) {
+		logger.Warn("Platform did not grant the edl_config scope. Treating deployment as disabled")
+		cfg.setDeploymentDisabled()
+		return nil
+	}
 
+	// Fetch EDL configuration, falling back to the one cached with the
+	// access token so a platform outage does not prevent startup
 	edlConfig, err := cfg.ConfigClient.GetEDLConfig(ctx)
 	if err != nil {
 		if api.IsPermanentError(err) {
 			cfg.setDeploymentDisabled()
 			return nil
 		}
-		return errors.New("failed to fetch EDL config: " + err.Error())
+		edlConfig = cfg.TokenManager.CachedEDLConfig()
+		if edlConfig == nil {
+			return errors.New("failed to fetch EDL config: " + err.Error())
+		}
+		logger.Warn("Failed to fetch EDL config, using cached config", "error", err)
 	}
 
 	// Apply EDL configuration
@@ -73,10 +179,12 @@ func (cfg *Config) InitializeServices(ctx context.Context) error {
 	return nil
 }
 
+// parseBootstrapToken only derives the device ID from the bootstrap token.
+// Its signature is verified by the token manager once the JWKS is known.
 func (cfg *Config) parseBootstrapToken() error {
 	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
 	var claims api.BootstrapClaims
-	_, _, _ = parser.ParseUnverified(cfg.BootstrapToken, &claims)
+	_, _, _ = parser.ParseUnverified(cfg.GetBootstrapToken(), &claims)
 
 	// Get protected machine ID using deployment ID as app key
 	machineID, err := machineid.ProtectedID(claims.DeploymentID)
@@ -89,36 +197,68 @@ func (cfg *Config) parseBootstrapToken() error {
 }
 
 func (cfg *Config) setDeploymentDisabled() {
-	cfg.DeploymentEnabled = false
-	cfg.EDLMode = "disabled"
-	cfg.UpdateFrequency = 1 * time.Hour
-	cfg.EDLURL = ""
+	cfg.setEDLSettings(cfg.disabledEDLSettings())
+}
+
+// disabledEDLSettings returns the settings used while the deployment is
+// disabled
+func (cfg *Config) disabledEDLSettings() EDLSettings {
+	settings := cfg.EDLSettings()
+	settings.Enabled = false
+	settings.Mode = "disabled"
+	settings.UpdateFrequency = 1 * time.Hour
+	settings.URL = ""
+	settings.DeltaURL = ""
+	if !cfg.eventsURLFromEnv {
+		settings.EventsURL = ""
+	}
+	return settings
 }
 
 func (cfg *Config) applyEDLConfig(edlConfig *api.EDLConfig) {
+	cfg.setEDLSettings(cfg.edlSettingsFor(edlConfig))
+}
+
+// edlSettingsFor returns the settings edlConfig describes, without
+// applying them
+func (cfg *Config) edlSettingsFor(edlConfig *api.EDLConfig) EDLSettings {
 	if !edlConfig.Enabled {
-		cfg.setDeploymentDisabled()
-		return
+		return cfg.disabledEDLSettings()
 	}
 
-	cfg.DeploymentEnabled = true
+	settings := cfg.EDLSettings()
+	settings.Enabled = true
 
 	// Map purpose to EDL mode
 	switch edlConfig.Purpose {
 	case "allowlist":
-		cfg.EDLMode = "allowlist"
+		settings.Mode = "allowlist"
 	case "blocklist", "other", "others":
-		cfg.EDLMode = "blocklist"
+		settings.Mode = "blocklist"
 	default:
-		cfg.EDLMode = "blocklist"
+		settings.Mode = "blocklist"
 	}
 
-	cfg.UpdateFrequency = time.Duration(edlConfig.UpdateFrequencySeconds) * time.Second
-	if cfg.UpdateFrequency <= 0 {
-		cfg.UpdateFrequency = 5 * time.Minute
+	settings.UpdateFrequency = time.Duration(edlConfig.UpdateFrequencySeconds) * time.Second
+	if settings.UpdateFrequency <= 0 {
+		settings.UpdateFrequency = 5 * time.Minute
 	}
 
 	if len(edlConfig.URLs.Combined) > 0 {
-		cfg.EDLURL = edlConfig.URLs.Combined[0]
+		settings.URL = edlConfig.URLs.Combined[0]
+	}
+
+	settings.DeltaURL = ""
+	if len(edlConfig.URLs.Delta) > 0 {
+		settings.DeltaURL = edlConfig.URLs.Delta[0]
+	}
+
+	// An explicitly configured event stream takes precedence
+	if !cfg.eventsURLFromEnv {
+		settings.EventsURL = ""
+		if len(edlConfig.URLs.Events) > 0 {
+			settings.EventsURL = edlConfig.URLs.Events[0]
+		}
 	}
+	return settings
 }
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
+)
+
+// FailMode decides how requests are answered when the EDL cannot be
+// enforced normally
+type FailMode string
+
+const (
+	// FailOpen allows all traffic
+	FailOpen FailMode = "open"
+	// FailClosed denies all traffic
+	FailClosed FailMode = "closed"
+	// FailLastKnownGood keeps evaluating against the last loaded EDL,
+	// denying all traffic if no EDL was ever loaded
+	FailLastKnownGood FailMode = "last-known-good"
+)
+
+// FailureCause identifies why the EDL cannot be enforced normally
+type FailureCause string
+
+const (
+	CauseDeploymentDisabled FailureCause = "deployment_disabled"
+	CauseDeploymentDeleted  FailureCause = "deployment_deleted"
+	CauseEDLStale           FailureCause = "edl_stale"
+)
+
+// Policy holds the behavior settings of one EDL purpose
+type Policy struct {
+	// FailMode applies to every failure cause when set. When empty,
+	// disabled and deleted deployments fail open and stale data keeps
+	// being served, which was the behavior before fail modes existed.
+	FailMode FailMode
+	// StaleMode overrides FailMode once the EDL exceeds its max age
+	StaleMode FailMode
+	// DenyStatus is the status code denied requests are answered with.
+	// Zero means 403.
+	DenyStatus int
+	// RedirectURL redirects denied browser requests instead of showing
+	// the block page when set, unless the deny status hides the denial.
+	// "{host}" in the path, query or fragment is replaced by the requested
+	// host.
+	RedirectURL string
+	// RedirectStatus is 302 or 307
+	RedirectStatus int
+}
+
+// DenyStatusCode returns the status code for denied requests
+func (p Policy) DenyStatusCode() int {
+	if p.DenyStatus != 0 {
+		return p.DenyStatus
+	}
+	return http.StatusForbidden
+}
+
+// HidesDenial reports whether denied requests look like a missing
+// resource, so nothing in the response may reveal the denial
+func (p Policy) HidesDenial() bool {
+	return p.DenyStatusCode() == http.StatusNotFound
+}
+
+// FailModeFor returns the fail mode that applies to cause
+func (p Policy) FailModeFor(cause FailureCause) FailMode {
+	if cause == CauseEDLStale && p.StaleMode != "" {
+		return p.StaleMode
+	}
+	if p.FailMode != "" {
+		return p.FailMode
+	}
+	if cause == CauseEDLStale {
+		return FailLastKnownGood
+	}
+	return FailOpen
+}
+
+// Policies holds the per-purpose policies. Default applies while the
+// purpose is unknown, e.g. when the deployment was never active.
+type Policies struct {
+	Default   Policy
+	Allowlist Policy
+	Blocklist Policy
+}
+
+// ForMode returns the policy for an EDL mode
+func (p Policies) ForMode(mode string) Policy {
+	switch mode {
+	case "allowlist":
+		return p.Allowlist
+	case "blocklist":
+		return p.Blocklist
+	default:
+		return p.Default
+	}
+}
+
+// RedirectsDenials reports whether any policy redirects denied requests
+func (p Policies) RedirectsDenials() bool {
+	for _, policy := range []Policy{p.Default, p.Allowlist, p.Blocklist} {
+		if policy.RedirectURL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func loadPolicies() Policies {
+	defaults := Policy{
+		FailMode:       parseFailMode("FAIL_MODE", ""),
+		StaleMode:      parseStaleMode("EDL_STALE_MODE", ""),
+		DenyStatus:     parseDenyStatus("DENY_STATUS", 0),
+		RedirectURL:    parseRedirectURL("DENY_REDIRECT_URL", ""),
+		RedirectStatus: parseRedirectStatus("DENY_REDIRECT_STATUS", http.StatusFound),
+	}
+
+	return Policies{
+		Default: defaults,
+		Allowlist: Policy{
+			FailMode:       parseFailMode("ALLOWLIST_FAIL_MODE", defaults.FailMode),
+			StaleMode:      parseStaleMode("ALLOWLIST_EDL_STALE_MODE", defaults.StaleMode),
+			DenyStatus:     parseDenyStatus("ALLOWLIST_DENY_STATUS", defaults.DenyStatus),
+			RedirectURL:    parseRedirectURL("ALLOWLIST_DENY_REDIRECT_URL", defaults.RedirectURL),
+			RedirectStatus: parseRedirectStatus("ALLOWLIST_DENY_REDIRECT_STATUS", defaults.RedirectStatus),
+		},
+		Blocklist: Policy{
+			FailMode:       parseFailMode("BLOCKLIST_FAIL_MODE", defaults.FailMode),
+			StaleMode:      parseStaleMode("BLOCKLIST_EDL_STALE_MODE", defaults.StaleMode),
+			DenyStatus:     parseDenyStatus("BLOCKLIST_DENY_STATUS", defaults.DenyStatus),
+			RedirectURL:    parseRedirectURL("BLOCKLIST_DENY_REDIRECT_URL", defaults.RedirectURL),
+			RedirectStatus: parseRedirectStatus("BLOCKLIST_DENY_REDIRECT_STATUS", defaults.RedirectStatus),
+		},
+	}
+}
+
+func parseFailMode(key string, defaultValue FailMode) FailMode {
+	value := strings.ToLower(utils.GetEnv(key, ""))
+	switch FailMode(value) {
+	case "":
+		return defaultValue
+	case FailOpen, FailClosed, FailLastKnownGood:
+		return FailMode(value)
+	default:
+		logger.Warn("Ignoring invalid fail mode", "variable", key, "value", value)
+		return defaultValue
+	}
+}
+
+// parseStaleMode parses a fail mode for stale data, which additionally
+// accepts "serve" to keep serving the loaded EDL
+func parseStaleMode(key string, defaultValue FailMode) FailMode {
+	if strings.ToLower(utils.GetEnv(key, "")) == "serve" {
+		return FailLastKnownGood
+	}
+	return parseFailMode(key, defaultValue)
+}
+
+func parseDenyStatus(key string, defaultValue int) int {
+	value := utils.GetEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	status, _ := strconv.Atoi(value)
+	switch status {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusTooManyRequests, http.StatusUnavailableForLegalReasons:
+		return status
+	default:
+		logger.Warn("Ignoring invalid deny status", "variable", key, "value", value)
+		return defaultValue
+	}
+}
+
+func parseRedirectURL(key string, defaultValue string) string {
+	value := utils.GetEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	// {host} comes from the client, so it is only allowed in the path,
+	// query and fragment; url.Parse rejects it in the authority, where it
+	// would redirect to any host the client names
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		logger.Warn("Ignoring invalid redirect URL, {host} may only be used in the path or query",
+			"variable", key,
+			"value", value)
+		return defaultValue
+	}
+	return value
+}
+
+func parseRedirectStatus(key string, defaultValue int) int {
+	value := utils.GetEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	status, _ := strconv.Atoi(value)
+	switch status {
+	case http.StatusFound, http.StatusTemporaryRedirect:
+		return status
+	default:
+		logger.Warn("Ignoring invalid redirect status", "variable", key, "value", value)
+		return defaultValue
+	}
+}
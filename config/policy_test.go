@@ -0,0 +1,60 @@
+package config
+
+import "testing"
+
+func TestLoadPoliciesServeAlias(t *testing.T) {
+	t.Setenv("FAIL_MODE", "serve")
+	t.Setenv("BLOCKLIST_EDL_STALE_MODE", "serve")
+
+	policies := loadPolicies()
+
+	if policies.Default.FailMode != "" {
+		t.Errorf("FAIL_MODE=serve parsed as %q, want it rejected", policies.Default.FailMode)
+	}
+	if policies.Blocklist.StaleMode != FailLastKnownGood {
+		t.Errorf("BLOCKLIST_EDL_STALE_MODE=serve parsed as %q, want %q", policies.Blocklist.StaleMode, FailLastKnownGood)
+	}
+}
+
+func TestFailModeForStaleData(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   FailMode
+	}{
+		{"default serves stale data", Policy{}, FailLastKnownGood},
+		{"fail mode applies to stale data", Policy{FailMode: FailClosed}, FailClosed},
+		{"stale mode overrides fail mode", Policy{FailMode: FailClosed, StaleMode: FailLastKnownGood}, FailLastKnownGood},
+		{"stale mode without fail mode", Policy{StaleMode: FailOpen}, FailOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.FailModeFor(CauseEDLStale); got != tt.want {
+				t.Errorf("FailModeFor(stale) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRedirectURLRejectsHostInAuthority(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"https://appeal.example.com/blocked", true},
+		{"https://appeal.example.com/{host}/blocked?site={host}", true},
+		{"https://{host}/blocked", false},
+		{"https://appeal.{host}/blocked", false},
+		{"https://{host}@appeal.example.com/blocked", false},
+		{"ftp://appeal.example.com/blocked", false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DENY_REDIRECT_URL", tt.value)
+		got := parseRedirectURL("DENY_REDIRECT_URL", "")
+		if (got != "") != tt.valid {
+			t.Errorf("parseRedirectURL(%q) = %q, valid %v", tt.value, got, tt.valid)
+		}
+	}
+}
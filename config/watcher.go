@@ -0,0 +1,267 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
+)
+
+// ChangeFunc is called with the previous and current settings whenever the
+// platform changes the EDL configuration, before the config is updated.
+// Returning an error leaves the change unapplied, so it is retried on the
+// next poll.
+type ChangeFunc func(ctx context.Context, old, new EDLSettings) error
+
+// StateFunc is called whenever the deployment moves to a different state
+type StateFunc func(old, new DeploymentState)
+
+// Watcher periodically re-reads the EDL configuration from the platform
+// and applies changes to the running process. It also drives the
+// deployment state machine: while the deployment is disabled or deleted it
+// keeps probing at DeploymentProbeInterval and moves back to active as
+// soon as the platform serves it again.
+//
+//	active   -> disabled  config reports the deployment disabled
+//	active   -> deleted   bootstrap answers 410 Gone
+//	disabled -> active    config reports the deployment enabled
+//	deleted  -> active    bootstrap succeeds again and config is enabled
+//	deleted  -> disabled  bootstrap succeeds but config is disabled
+type Watcher struct {
+	cfg *Config
+
+	mu             sync.Mutex
+	listeners      []ChangeFunc
+	stateListeners []StateFunc
+	state          DeploymentState
+	version        int64
+	lastCheck      time.Time
+	lastError      error
+}
+
+func NewWatcher(cfg *Config) *Watcher {
+	return &Watcher{
+		cfg:   cfg,
+		state: cfg.GetDeploymentState(),
+	}
+}
+
+// OnChange registers fn to be called after each applied change.
+// Listeners run sequentially in registration order.
+func (w *Watcher) OnChange(fn ChangeFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners = append(w.listeners, fn)
+}
+
+// OnStateChange registers fn to be called after each state transition
+func (w *Watcher) OnStateChange(fn StateFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stateListeners = append(w.stateListeners, fn)
+}
+
+// State returns the current deployment state
+func (w *Watcher) State() DeploymentState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+func (w *Watcher) Start(ctx context.Context) {
+	metrics.ConfigVersion.Set(0)
+	setStateMetric(w.State())
+
+	if w.cfg.ConfigPollInterval <= 0 && w.State().IsActive() {
+		logger.Debug("Config polling disabled")
+		return
+	}
+
+	go w.run(ctx)
+}
+
+func (w *Watcher) run(ctx context.Context) {
+	timer := time.NewTimer(w.nextCheck())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if err := w.CheckNow(ctx); err != nil {
+				logger.Warn("Config poll failed", "error", err)
+			}
+
+			next := w.nextCheck()
+			if next <= 0 {
+				logger.Debug("Config polling disabled")
+				return
+			}
+			timer.Reset(next)
+		}
+	}
+}
+
+// nextCheck returns the delay until the next poll: the regular config
+// poll interval while active, the probe interval otherwise
+func (w *Watcher) nextCheck() time.Duration {
+	if w.State().IsActive() {
+		return w.cfg.ConfigPollInterval
+	}
+	return w.cfg.DeploymentProbeInterval
+}
+
+// CheckNow fetches the EDL configuration and applies it if it changed
+func (w *Watcher) CheckNow(ctx context.Context) error {
+	err := w.check(ctx)
+
+	w.mu.Lock()
+	w.lastCheck = time.Now()
+	w.lastError = err
+	w.mu.Unlock()
+
+	if err != nil {
+		metrics.ConfigPollsTotal.WithLabelValues("failure").Inc()
+	} else {
+		metrics.ConfigPollsTotal.WithLabelValues("success").Inc()
+	}
+	return err
+}
+
+func (w *Watcher) check(ctx context.Context) error {
+	if w.cfg.ConfigClient == nil {
+		return errors.New("config client not initialized")
+	}
+	defer w.updateState()
+
+	// A deleted deployment has no access token, so bootstrap has to
+	// succeed again before the config can be read
+	if tm := w.cfg.TokenManager; tm != nil && tm.IsDeploymentDeleted() {
+		if err := tm.Probe(ctx); err != nil {
+			if api.IsPermanentError(err) {
+				return w.apply(ctx, &api.EDLConfig{Enabled: false, Purpose: "disabled"})
+			}
+			return err
+		}
+	}
+
+	edlConfig, err := w.cfg.ConfigClient.GetEDLConfig(ctx)
+	if err != nil {
+		if !api.IsPermanentError(err) {
+			return err
+		}
+		edlConfig = &api.EDLConfig{Enabled: false, Purpose: "disabled"}
+	}
+
+	return w.apply(ctx, edlConfig)
+}
+
+// apply notifies listeners if edlConfig changes the settings, and stores
+// the new settings once all listeners accepted them. Listeners see the
+// new settings only through their arguments, so nothing reading the
+// config acts on them early. If a listener fails, nothing is stored, the
+// deployment state is unchanged and the next poll retries the change.
+func (w *Watcher) apply(ctx context.Context, edlConfig *api.EDLConfig) error {
+	old := w.cfg.EDLSettings()
+	current := w.cfg.edlSettingsFor(edlConfig)
+
+	if old == current {
+		return nil
+	}
+
+	w.mu.Lock()
+	listeners := append([]ChangeFunc(nil), w.listeners...)
+	w.mu.Unlock()
+
+	for _, fn := range listeners {
+		if err := fn(ctx, old, current); err != nil {
+			return errors.New("failed to apply EDL configuration change: " + err.Error())
+		}
+	}
+	w.cfg.setEDLSettings(current)
+
+	w.mu.Lock()
+	w.version++
+	version := w.version
+	w.mu.Unlock()
+
+	metrics.ConfigVersion.Set(float64(version))
+	logger.Info("EDL configuration changed",
+		append([]any{"event", "config_change", "version", version}, settingsDiff(old, current)...)...)
+	return nil
+}
+
+// updateState moves the state machine to the state implied by the current
+// configuration and token manager
+func (w *Watcher) updateState() {
+	next := w.cfg.GetDeploymentState()
+
+	w.mu.Lock()
+	prev := w.state
+	w.state = next
+	listeners := append([]StateFunc(nil), w.stateListeners...)
+	w.mu.Unlock()
+
+	if prev == next {
+		return
+	}
+
+	setStateMetric(next)
+	metrics.DeploymentStateTransitionsTotal.WithLabelValues(prev.String(), next.String()).Inc()
+	logger.Info("Deployment state changed",
+		"event", "deployment_state_change",
+		"from", prev.String(),
+		"to", next.String())
+
+	for _, fn := range listeners {
+		fn(prev, next)
+	}
+}
+
+func setStateMetric(state DeploymentState) {
+	for _, s := range []DeploymentState{DeploymentActive, DeploymentDisabled, DeploymentDeleted} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		metrics.DeploymentState.WithLabelValues(s.String()).Set(value)
+	}
+}
+
+// GetStatus returns the local config version, the time of the last poll
+// and its error, if any
+func (w *Watcher) GetStatus() (int64, time.Time, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.version, w.lastCheck, w.lastError
+}
+
+// settingsDiff returns log attributes describing each changed setting
+func settingsDiff(old, new EDLSettings) []any {
+	var diff []any
+	if old.Enabled != new.Enabled {
+		diff = append(diff, slog.Group("enabled", "old", old.Enabled, "new", new.Enabled))
+	}
+	if old.Mode != new.Mode {
+		diff = append(diff, slog.Group("mode", "old", old.Mode, "new", new.Mode))
+	}
+	if old.URL != new.URL {
+		diff = append(diff, slog.Group("url", "old", old.URL, "new", new.URL))
+	}
+	if old.DeltaURL != new.DeltaURL {
+		diff = append(diff, slog.Group("delta_url", "old", old.DeltaURL, "new", new.DeltaURL))
+	}
+	if old.EventsURL != new.EventsURL {
+		diff = append(diff, slog.Group("events_url", "old", old.EventsURL, "new", new.EventsURL))
+	}
+	if old.UpdateFrequency != new.UpdateFrequency {
+		diff = append(diff, slog.Group("update_frequency", "old", old.UpdateFrequency, "new", new.UpdateFrequency))
+	}
+	return diff
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
+)
+
+func newTestConfig() *Config {
+	return &Config{
+		DeploymentEnabled: true,
+		EDLMode:           "blocklist",
+		EDLURL:            "https://edl.example.com/blocklist",
+		UpdateFrequency:   5 * time.Minute,
+	}
+}
+
+func allowlistConfig() *api.EDLConfig {
+	return &api.EDLConfig{
+		Enabled:                true,
+		Purpose:                "allowlist",
+		UpdateFrequencySeconds: 300,
+		URLs:                   api.EDLURLs{Combined: []string{"https://edl.example.com/allowlist"}},
+	}
+}
+
+func TestWatcherRollsBackFailedChange(t *testing.T) {
+	cfg := newTestConfig()
+	w := NewWatcher(cfg)
+	before := cfg.EDLSettings()
+
+	var calls int
+	fail := true
+	w.OnChange(func(ctx context.Context, old, new EDLSettings) error {
+		calls++
+		if old != before || new.Mode != "allowlist" {
+			t.Errorf("unexpected change %+v -> %+v", old, new)
+		}
+		if fail {
+			return errors.New("fetch failed")
+		}
+		return nil
+	})
+
+	if err := w.apply(context.Background(), allowlistConfig()); err == nil {
+		t.Fatal("apply succeeded despite failing listener")
+	}
+	if got := cfg.EDLSettings(); got != before {
+		t.Errorf("settings after failed change = %+v, want %+v", got, before)
+	}
+	if version, _, _ := w.GetStatus(); version != 0 {
+		t.Errorf("version = %d, want 0", version)
+	}
+
+	// The next poll sees the same config as a change again and retries
+	fail = false
+	if err := w.apply(context.Background(), allowlistConfig()); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if got := cfg.EDLSettings(); got.Mode != "allowlist" || got.URL != "https://edl.example.com/allowlist" {
+		t.Errorf("settings after retry = %+v", got)
+	}
+	if version, _, _ := w.GetStatus(); version != 1 {
+		t.Errorf("version = %d, want 1", version)
+	}
+	if calls != 2 {
+		t.Errorf("listener calls = %d, want 2", calls)
+	}
+
+	// Unchanged config does not notify
+	if err := w.apply(context.Background(), allowlistConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("listener calls after unchanged config = %d, want 2", calls)
+	}
+}
+
+func TestWatcherKeepsStateOnFailedChange(t *testing.T) {
+	cfg := newTestConfig()
+	w := NewWatcher(cfg)
+
+	var states []DeploymentState
+	w.OnStateChange(func(old, new DeploymentState) {
+		states = append(states, new)
+	})
+	w.OnChange(func(ctx context.Context, old, new EDLSettings) error {
+		return errors.New("reconfigure failed")
+	})
+
+	err := w.apply(context.Background(), &api.EDLConfig{Enabled: false, Purpose: "disabled"})
+	w.updateState()
+	if err == nil {
+		t.Fatal("apply succeeded despite failing listener")
+	}
+	if state := w.State(); state != DeploymentActive {
+		t.Errorf("state = %v, want active", state)
+	}
+	if len(states) != 0 {
+		t.Errorf("state listeners called with %v", states)
+	}
+}
+
+func TestWatcherStoresSettingsAfterListeners(t *testing.T) {
+	cfg := newTestConfig()
+	w := NewWatcher(cfg)
+	before := cfg.EDLSettings()
+
+	w.OnChange(func(ctx context.Context, old, new EDLSettings) error {
+		// Background readers of the config must not see the new settings
+		// before the listeners have acted on them
+		if got := cfg.EDLSettings(); got != before {
+			t.Errorf("config changed to %+v before listeners ran", got)
+		}
+		return nil
+	})
+
+	if err := w.apply(context.Background(), allowlistConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.EDLSettings(); got.Mode != "allowlist" {
+		t.Errorf("settings after change = %+v", got)
+	}
+}
+
+func TestDisabledDeploymentDropsEventsURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		fromEnv bool
+		want    string
+	}{
+		{"from platform", false, ""},
+		{"from environment", true, "https://events.example.com/stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.EDLEventsURL = "https://events.example.com/stream"
+			cfg.eventsURLFromEnv = tt.fromEnv
+
+			cfg.setDeploymentDisabled()
+			if got := cfg.EDLSettings().EventsURL; got != tt.want {
+				t.Errorf("events URL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcherStateTransitions(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.ConfigPollInterval = time.Minute
+	cfg.DeploymentProbeInterval = 10 * time.Second
+	w := NewWatcher(cfg)
+
+	var transitions []string
+	w.OnStateChange(func(old, new DeploymentState) {
+		transitions = append(transitions, old.String()+" -> "+new.String())
+	})
+	var enabled []bool
+	w.OnChange(func(ctx context.Context, old, new EDLSettings) error {
+		enabled = append(enabled, new.Enabled)
+		return nil
+	})
+
+	disabled := &api.EDLConfig{Enabled: false, Purpose: "disabled"}
+	steps := []struct {
+		name      string
+		edlConfig *api.EDLConfig
+		want      DeploymentState
+		next      time.Duration
+	}{
+		{"disabled", disabled, DeploymentDisabled, cfg.DeploymentProbeInterval},
+		{"still disabled", disabled, DeploymentDisabled, cfg.DeploymentProbeInterval},
+		{"re-enabled", allowlistConfig(), DeploymentActive, cfg.ConfigPollInterval},
+		{"still active", allowlistConfig(), DeploymentActive, cfg.ConfigPollInterval},
+	}
+
+	for _, step := range steps {
+		if err := w.apply(context.Background(), step.edlConfig); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		w.updateState()
+
+		if state := w.State(); state != step.want {
+			t.Errorf("%s: state = %v, want %v", step.name, state, step.want)
+		}
+		// Disabled deployments are probed instead of polled
+		if next := w.nextCheck(); next != step.next {
+			t.Errorf("%s: next check in %v, want %v", step.name, next, step.next)
+		}
+	}
+
+	want := []string{"active -> disabled", "disabled -> active"}
+	if len(transitions) != len(want) || transitions[0] != want[0] || transitions[1] != want[1] {
+		t.Errorf("transitions = %v, want %v", transitions, want)
+	}
+	// Re-enabling hands the enabled settings to the updater
+	if len(enabled) != 2 || enabled[0] || !enabled[1] {
+		t.Errorf("listeners saw enabled = %v, want [false true]", enabled)
+	}
+}
+
+func TestWatcherKeepsStateOnFailedPoll(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.DeploymentProbeInterval = 10 * time.Second
+	cfg.setDeploymentDisabled()
+	w := NewWatcher(cfg)
+
+	var transitions int
+	w.OnStateChange(func(old, new DeploymentState) {
+		transitions++
+	})
+
+	// Without a config client the poll fails before anything is applied
+	if err := w.CheckNow(context.Background()); err == nil {
+		t.Fatal("poll succeeded without a config client")
+	}
+	if state := w.State(); state != DeploymentDisabled {
+		t.Errorf("state = %v, want disabled", state)
+	}
+	if transitions != 0 {
+		t.Errorf("state listeners called %d times", transitions)
+	}
+	if _, lastCheck, lastErr := w.GetStatus(); lastCheck.IsZero() || lastErr == nil {
+		t.Errorf("failed poll not recorded: last check %v, error %v", lastCheck, lastErr)
+	}
+	if next := w.nextCheck(); next != cfg.DeploymentProbeInterval {
+		t.Errorf("next check in %v, want %v", next, cfg.DeploymentProbeInterval)
+	}
+}
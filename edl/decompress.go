@@ -0,0 +1,187 @@
+package edl
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is advertised on every EDL request. Go's transport only
+// negotiates gzip on its own, so decoding is handled here instead.
+const acceptEncoding = "gzip, deflate, zstd, br"
+
+// maxDecodedSize caps how many bytes an EDL may decompress to, so a small
+// compressed body cannot expand without bound
+const maxDecodedSize = 512 << 20
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ErrDecodedTooLarge is returned when a downloaded EDL decompresses to
+// more than the size limit
+var ErrDecodedTooLarge = errors.New("decompressed EDL exceeds size limit")
+
+// limitedReader fails with ErrDecodedTooLarge once more than remaining
+// bytes are read. Unlike io.LimitReader it never truncates silently, which
+// would load a partial list.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Only data beyond the limit is an error, not a body of exactly
+		// the limit
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrDecodedTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodedBody wraps the decompressing reader so that Close releases the
+// decoder as well as the underlying response body.
+type decodedBody struct {
+	io.Reader
+	closeFn func() error
+}
+
+func (d *decodedBody) Close() error {
+	return d.closeFn()
+}
+
+// decodeBody returns a reader yielding the decompressed EDL content, which
+// fails once more than limit bytes were decompressed. The body is decoded
+// as a stream; nothing is buffered beyond what the decoders need
+// internally.
+func decodeBody(resp *http.Response, body io.ReadCloser, limit int64) (io.ReadCloser, string, error) {
+	decoded, encoding, err := newDecoder(resp, body)
+	if err != nil {
+		return nil, "", err
+	}
+	return &decodedBody{Reader: &limitedReader{r: decoded, remaining: limit}, closeFn: decoded.Close}, encoding, nil
+}
+
+// newDecoder returns a reader decompressing body according to the
+// response's Content-Encoding
+func newDecoder(resp *http.Response, body io.ReadCloser) (io.ReadCloser, string, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+
+	switch encoding {
+	case "", "identity":
+		// Lists published as .gz files are usually served as
+		// application/octet-stream without a Content-Encoding header
+		if isGzipURL(resp.Request) {
+			return sniffGzip(body)
+		}
+		return body, "identity", nil
+
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, "", errors.New("failed to open gzip stream: " + err.Error())
+		}
+		return &decodedBody{Reader: gz, closeFn: func() error {
+			_ = gz.Close()
+			return body.Close()
+		}}, "gzip", nil
+
+	case "deflate":
+		return newDeflateReader(body)
+
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", errors.New("failed to open zstd stream: " + err.Error())
+		}
+		return &decodedBody{Reader: zr, closeFn: func() error {
+			zr.Close()
+			return body.Close()
+		}}, "zstd", nil
+
+	case "br":
+		return &decodedBody{Reader: brotli.NewReader(body), closeFn: body.Close}, "br", nil
+
+	default:
+		return nil, "", errors.New("unsupported content encoding: " + encoding)
+	}
+}
+
+// sniffGzip decodes the body as gzip if it starts with the gzip magic bytes,
+// and passes it through unchanged otherwise.
+func sniffGzip(body io.ReadCloser) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(len(gzipMagic))
+	if err != nil || header[0] != gzipMagic[0] || header[1] != gzipMagic[1] {
+		return &decodedBody{Reader: br, closeFn: body.Close}, "identity", nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, "", errors.New("failed to open gzip stream: " + err.Error())
+	}
+	return &decodedBody{Reader: gz, closeFn: func() error {
+		_ = gz.Close()
+		return body.Close()
+	}}, "gzip", nil
+}
+
+// newDeflateReader decodes a deflate body. The encoding is specified as
+// zlib-wrapped, but some servers send raw deflate, so the zlib header is
+// checked first.
+func newDeflateReader(body io.ReadCloser) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, "", errors.New("failed to open deflate stream: " + err.Error())
+		}
+		return &decodedBody{Reader: zr, closeFn: func() error {
+			_ = zr.Close()
+			return body.Close()
+		}}, "deflate", nil
+	}
+
+	fr := flate.NewReader(br)
+	return &decodedBody{Reader: fr, closeFn: func() error {
+		_ = fr.Close()
+		return body.Close()
+	}}, "deflate", nil
+}
+
+func isGzipURL(req *http.Request) bool {
+	if req == nil || req.URL == nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(req.URL.Path), ".gz")
+}
@@ -0,0 +1,182 @@
+package edl
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const testList = "192.0.2.1\n198.51.100.0/24\n2001:db8::/32\n"
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testResponse(t *testing.T, url, contentEncoding string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{Header: http.Header{}, Request: req}
+	if contentEncoding != "" {
+		resp.Header.Set("Content-Encoding", contentEncoding)
+	}
+	return resp
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name            string
+		url             string
+		contentEncoding string
+		body            []byte
+		encoding        string
+	}{
+		{"identity", "https://edl.example.com/list", "", []byte(testList), "identity"},
+		{"gzip", "https://edl.example.com/list", "gzip", compress(t, "gzip", []byte(testList)), "gzip"},
+		{"x-gzip", "https://edl.example.com/list", "x-gzip", compress(t, "gzip", []byte(testList)), "gzip"},
+		{"deflate", "https://edl.example.com/list", "deflate", compress(t, "zlib", []byte(testList)), "deflate"},
+		{"raw deflate", "https://edl.example.com/list", "deflate", compress(t, "flate", []byte(testList)), "deflate"},
+		{"zstd", "https://edl.example.com/list", "zstd", compress(t, "zstd", []byte(testList)), "zstd"},
+		{"br", "https://edl.example.com/list", "br", compress(t, "br", []byte(testList)), "br"},
+		{"gz url", "https://edl.example.com/list.gz", "", compress(t, "gzip", []byte(testList)), "gzip"},
+		{"plain gz url", "https://edl.example.com/list.gz", "", []byte(testList), "identity"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testResponse(t, tt.url, tt.contentEncoding)
+			body, encoding, err := decodeBody(resp, io.NopCloser(bytes.NewReader(tt.body)), maxDecodedSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			if encoding != tt.encoding {
+				t.Errorf("encoding = %q, want %q", encoding, tt.encoding)
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != testList {
+				t.Errorf("decoded = %q, want %q", data, testList)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyRejectsCorruptStreams(t *testing.T) {
+	gz := compress(t, "gzip", []byte(testList))
+	corrupt := append([]byte(nil), gz...)
+	// Flip bits in the compressed data, past the gzip header
+	for i := 10; i < len(corrupt)-8; i++ {
+		corrupt[i] ^= 0xff
+	}
+
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+	}{
+		{"not gzip", "gzip", []byte(testList)},
+		{"corrupt gzip", "gzip", corrupt},
+		{"truncated gzip", "gzip", gz[:len(gz)/2]},
+		{"corrupt deflate", "deflate", []byte(testList)},
+		{"corrupt zstd", "zstd", []byte(testList)},
+		{"unsupported encoding", "compress", []byte(testList)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testResponse(t, "https://edl.example.com/list", tt.contentEncoding)
+			body, _, err := decodeBody(resp, io.NopCloser(bytes.NewReader(tt.body)), maxDecodedSize)
+			if err == nil {
+				defer body.Close()
+				_, err = io.ReadAll(body)
+			}
+			if err == nil {
+				t.Error("corrupt stream decoded without error")
+			}
+		})
+	}
+}
+
+func TestDecodeBodyLimitsDecompressedSize(t *testing.T) {
+	const limit = 64 << 10
+
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"below limit", limit - 1, false},
+		{"at limit", limit, false},
+		{"bomb", 64 * limit, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Long runs of one byte compress to almost nothing
+			payload := compress(t, "gzip", []byte(strings.Repeat("0", tt.size)))
+			resp := testResponse(t, "https://edl.example.com/list", "gzip")
+			body, _, err := decodeBody(resp, io.NopCloser(bytes.NewReader(payload)), limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			data, err := io.ReadAll(body)
+			if tt.wantErr {
+				if !errors.Is(err, ErrDecodedTooLarge) {
+					t.Errorf("error = %v, want ErrDecodedTooLarge", err)
+				}
+				if len(data) > limit {
+					t.Errorf("read %d bytes past the limit of %d", len(data), limit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != tt.size {
+				t.Errorf("read %d bytes, want %d", len(data), tt.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package edl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Delta holds the entries added to and removed from an EDL since a cursor
+type Delta struct {
+	Added   []netip.Prefix
+	Removed []netip.Prefix
+	Cursor  string
+}
+
+// IsEmpty reports whether the delta carries no changes
+func (d *Delta) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// Apply applies the delta to entries and returns the change in entry
+// count. Removals are applied before additions, so an entry that was
+// removed and re-added within the same delta ends up present. Entries are
+// matched exactly: removing 10.0.0.5/32 leaves a listed 10.0.0.0/8 intact,
+// and re-adding a listed entry or removing an unlisted one changes nothing.
+func (d *Delta) Apply(entries Entries) int64 {
+	var change int64
+	for _, prefix := range d.Removed {
+		if entries.remove(prefix) {
+			change--
+		}
+	}
+	for _, prefix := range d.Added {
+		if entries.add(prefix) {
+			change++
+		}
+	}
+	return change
+}
+
+func (f *Fetcher) FetchDeltaWithRetry(ctx context.Context, deltaURL, cursor string) (*Delta, error) {
+	var delta *Delta
+
+	err := f.withRetry(ctx, "EDL delta fetch", func() error {
+		var err error
+		delta, err = f.fetchDelta(ctx, deltaURL, cursor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return delta, nil
+}
+
+func (f *Fetcher) fetchDelta(ctx context.Context, deltaURL, cursor string) (*Delta, error) {
+	reqURL, err := url.Parse(deltaURL)
+	if err != nil {
+		return nil, errors.New("invalid delta URL: " + err.Error())
+	}
+	query := reqURL.Query()
+	query.Set("cursor", cursor)
+	reqURL.RawQuery = query.Encode()
+
+	body, nextCursor, err := f.get(ctx, reqURL.String())
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			switch statusErr.StatusCode {
+			case http.StatusNotModified:
+				return &Delta{Cursor: cursor}, nil
+			case http.StatusConflict, http.StatusGone:
+				return nil, ErrCursorRejected
+			}
+		}
+		return nil, err
+	}
+	defer body.Close()
+
+	if nextCursor == "" {
+		return nil, errors.New("delta response missing " + cursorHeader + " header")
+	}
+
+	delta, err := parseDelta(body)
+	if err != nil {
+		return nil, err
+	}
+	delta.Cursor = nextCursor
+
+	return delta, nil
+}
+
+// parseDelta reads a delta feed where each line is an IP address or CIDR
+// prefixed with "+" (added) or "-" (removed)
+func parseDelta(r io.Reader) (*Delta, error) {
+	delta := &Delta{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) < 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		prefix, ok := parseEntry(strings.TrimSpace(line[1:]))
+		if !ok {
+			// Skip invalid entries silently, as in full lists
+			continue
+		}
+
+		switch line[0] {
+		case '+':
+			delta.Added = append(delta.Added, prefix)
+		case '-':
+			delta.Removed = append(delta.Removed, prefix)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return delta, nil
+}
+
+// parseEntry parses a CIDR prefix or a single IP address
+func parseEntry(entry string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		return prefix, true
+	}
+	if addr, err := netip.ParseAddr(entry); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
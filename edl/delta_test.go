@@ -0,0 +1,143 @@
+package edl
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestDeltaApplyCountsMembershipChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		added   []string
+		removed []string
+		change  int64
+	}{
+		{"add new", []string{"198.51.100.1/32"}, nil, 1},
+		{"re-add existing", []string{"192.0.2.1/32"}, nil, 0},
+		{"duplicate add", []string{"198.51.100.1/32", "198.51.100.1/32"}, nil, 1},
+		{"remove existing", nil, []string{"10.0.0.0/8"}, -1},
+		{"remove absent", nil, []string{"203.0.113.1/32"}, 0},
+		{"duplicate remove", nil, []string{"10.0.0.0/8", "10.0.0.0/8"}, -1},
+		{"remove and re-add", []string{"192.0.2.1/32"}, []string{"192.0.2.1/32"}, 0},
+		{"remove absent and add", []string{"203.0.113.1/32"}, []string{"203.0.113.1/32"}, 1},
+		{"add covered by listed prefix", []string{"10.1.2.3/32"}, nil, 1},
+		{"remove covered but unlisted", nil, []string{"10.0.0.5/32"}, 0},
+		{"add unmasked form of listed prefix", []string{"10.9.9.9/8"}, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := testEntries("192.0.2.1/32", "10.0.0.0/8")
+			delta := &Delta{}
+			for _, p := range tt.added {
+				delta.Added = append(delta.Added, netip.MustParsePrefix(p))
+			}
+			for _, p := range tt.removed {
+				delta.Removed = append(delta.Removed, netip.MustParsePrefix(p))
+			}
+
+			change := delta.Apply(entries)
+			if change != tt.change {
+				t.Errorf("change = %d, want %d", change, tt.change)
+			}
+			if want := int64(2) + tt.change; int64(len(entries)) != want {
+				t.Errorf("len(entries) = %d, want %d", len(entries), want)
+			}
+
+			ipset, err := entries.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.added {
+				if !ipset.ContainsPrefix(netip.MustParsePrefix(p).Masked()) {
+					t.Errorf("added prefix %s missing from set", p)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaRemovalKeepsOverlappingEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []string
+		removed  []string
+		contains map[string]bool
+		count    int
+	}{
+		{
+			name:     "host inside listed network",
+			entries:  []string{"10.0.0.0/8", "10.0.0.5/32"},
+			removed:  []string{"10.0.0.5/32"},
+			contains: map[string]bool{"10.0.0.5": true, "10.0.0.6": true},
+			count:    1,
+		},
+		{
+			name:     "network around listed host",
+			entries:  []string{"10.0.0.0/8", "10.0.0.5/32"},
+			removed:  []string{"10.0.0.0/8"},
+			contains: map[string]bool{"10.0.0.5": true, "10.0.0.6": false},
+			count:    1,
+		},
+		{
+			name:     "unlisted host inside listed network",
+			entries:  []string{"10.0.0.0/8"},
+			removed:  []string{"10.0.0.5/32"},
+			contains: map[string]bool{"10.0.0.5": true},
+			count:    1,
+		},
+		{
+			name:     "overlapping networks",
+			entries:  []string{"10.0.0.0/8", "10.0.0.0/16"},
+			removed:  []string{"10.0.0.0/16"},
+			contains: map[string]bool{"10.0.1.1": true, "10.1.0.1": true},
+			count:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := testEntries(tt.entries...)
+			delta := &Delta{}
+			for _, p := range tt.removed {
+				delta.Removed = append(delta.Removed, netip.MustParsePrefix(p))
+			}
+			delta.Apply(entries)
+
+			ipset, err := entries.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ip, want := range tt.contains {
+				if got := ipset.Contains(netip.MustParseAddr(ip)); got != want {
+					t.Errorf("Contains(%s) = %v, want %v", ip, got, want)
+				}
+			}
+			if len(entries) != tt.count {
+				t.Errorf("len(entries) = %d, want %d", len(entries), tt.count)
+			}
+		})
+	}
+}
+
+func testEntries(prefixes ...string) Entries {
+	entries := Entries{}
+	for _, p := range prefixes {
+		entries.add(netip.MustParsePrefix(p))
+	}
+	return entries
+}
+
+func TestParseDelta(t *testing.T) {
+	delta, err := parseDelta(strings.NewReader("# comment\n+192.0.2.1\n-10.0.0.0/8\ninvalid\n+bogus\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Added) != 1 || delta.Added[0] != netip.MustParsePrefix("192.0.2.1/32") {
+		t.Errorf("Added = %v", delta.Added)
+	}
+	if len(delta.Removed) != 1 || delta.Removed[0] != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("Removed = %v", delta.Removed)
+	}
+}
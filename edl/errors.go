@@ -0,0 +1,32 @@
+package edl
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrCursorRejected is returned when the delta feed no longer recognizes the
+// cursor it was given and a full fetch is needed to resynchronize
+var ErrCursorRejected = errors.New("delta cursor rejected")
+
+// StatusError is returned when the EDL server answers with a non-200 status
+type StatusError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is the delay requested by the server on 429/503, if any
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected status " + strconv.Itoa(e.StatusCode) + ": " + e.Message
+}
+
+// retryAfter extracts the server-requested retry delay from err
+func retryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
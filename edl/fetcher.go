@@ -13,6 +13,8 @@ import (
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
 	"go4.org/netipx"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
 	"github.com/getsentry/sentry-go"
 )
 
@@ -28,7 +30,7 @@ func NewFetcher(cfg *config.Config) *Fetcher {
 			Transport: &http.Transport{
 				MaxIdleConns:        10,
 				IdleConnTimeout:     30 * time.Second,
-				DisableCompression:  true,
+				DisableCompression:  true, // Accept-Encoding is negotiated in fetch
 				MaxIdleConnsPerHost: 2,
 			},
 		},
@@ -36,58 +38,145 @@ func NewFetcher(cfg *config.Config) *Fetcher {
 	}
 }
 
-func (f *Fetcher) FetchWithRetry(ctx context.Context) (*netipx.IPSet, int64, error) {
+const (
+	// cursorHeader carries the EDL version a response corresponds to. It is
+	// passed back to the delta feed to request changes since that version.
+	cursorHeader = "X-EDL-Cursor"
+
+	// maxRetryDelay caps the wait between attempts within one update cycle.
+	// Longer Retry-After requests end the cycle and are honored by the
+	// updater's scheduler instead.
+	maxRetryDelay = 2 * time.Minute
+
+	// retryJitter spreads retries of a fleet of replicas apart
+	retryJitter = 0.2
+)
+
+func (f *Fetcher) FetchWithRetry(ctx context.Context, url string) (Entries, string, error) {
+	var entries Entries
+	var cursor string
+
+	err := f.withRetry(ctx, "EDL fetch", func() error {
+		var err error
+		entries, cursor, err = f.fetch(ctx, url)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entries, cursor, nil
+}
+
+// withRetry runs op up to MaxRetryAttempts times with jittered exponential
+// backoff, stopping early on success or when op reports an error that
+// retrying within this cycle cannot fix.
+func (f *Fetcher) withRetry(ctx context.Context, name string, op func() error) error {
 	var lastErr error
+	var delay time.Duration
 
 	for attempt := 0; attempt < f.config.MaxRetryAttempts; attempt++ {
 		if attempt > 0 {
 			select {
 			case <-ctx.Done():
-				return nil, 0, ctx.Err()
-			case <-time.After(f.config.RetryDelay * time.Duration(attempt)):
+				return ctx.Err()
+			case <-time.After(delay):
 			}
 		}
 
-		ipset, count, err := f.fetch(ctx)
+		err := op()
 		if err == nil {
-			return ipset, count, nil
+			return nil
 		}
 
 		lastErr = err
-		logger.Debug("EDL fetch attempt failed",
+		logger.Debug(name+" attempt failed",
 			"attempt", attempt+1,
 			"max_attempts", f.config.MaxRetryAttempts,
 			"error", err)
+
+		if errors.Is(err, ErrCursorRejected) {
+			return err
+		}
+
+		delay = utils.Jitter(utils.Backoff(f.config.RetryDelay, maxRetryDelay, attempt), retryJitter)
+		if wait := retryAfter(err); wait > 0 {
+			if wait > maxRetryDelay {
+				break
+			}
+			delay = wait
+		}
 	}
 
 	// Capture final failure to Sentry
 	sentry.CaptureException(lastErr)
-	return nil, 0, lastErr
+	return lastErr
+}
+
+func (f *Fetcher) fetch(ctx context.Context, url string) (Entries, string, error) {
+	body, cursor, err := f.get(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+
+	entries, err := f.parseEDL(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entries, cursor, nil
 }
 
-func (f *Fetcher) fetch(ctx context.Context) (*netipx.IPSet, int64, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", f.config.EDLURL, nil)
+// get issues a GET for an EDL resource and returns the decoded body along
+// with the cursor reported by the server. Byte counters are recorded when
+// the body is closed.
+func (f *Fetcher) get(ctx context.Context, url string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, 0, err
+		return nil, "", err
 	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 
 	resp, err := f.client.Do(req)
 	if err != nil {
-		return nil, 0, err
+		return nil, "", err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return nil, 0, errors.New("unexpected status: " + string(body))
+		statusErr := &StatusError{StatusCode: resp.StatusCode, Message: string(body)}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = utils.ParseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return nil, "", statusErr
+	}
+
+	wire := &countingReader{r: resp.Body}
+	body, encoding, err := decodeBody(resp, io.NopCloser(wire), maxDecodedSize)
+	if err != nil {
+		resp.Body.Close()
+		return nil, "", err
 	}
 
-	return f.parseEDL(resp.Body)
+	parsed := &countingReader{r: body}
+	return &decodedBody{Reader: parsed, closeFn: func() error {
+		metrics.EDLDownloadBytesTotal.WithLabelValues("transferred").Add(float64(wire.n))
+		metrics.EDLDownloadBytesTotal.WithLabelValues("parsed").Add(float64(parsed.n))
+		logger.Debug("EDL downloaded",
+			"url", url,
+			"encoding", encoding,
+			"bytes_transferred", wire.n,
+			"bytes_parsed", parsed.n)
+
+		_ = body.Close()
+		return resp.Body.Close()
+	}}, resp.Header.Get(cursorHeader), nil
 }
 
-func (f *Fetcher) parseEDL(r io.Reader) (*netipx.IPSet, int64, error) {
-	var b netipx.IPSetBuilder
-	var count int64
+func (f *Fetcher) parseEDL(r io.Reader) (Entries, error) {
+	entries := Entries{}
 	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
@@ -97,30 +186,53 @@ func (f *Fetcher) parseEDL(r io.Reader) (*netipx.IPSet, int64, error) {
 			continue
 		}
 
-		// Try parsing as CIDR prefix first
-		if prefix, err := netip.ParsePrefix(line); err == nil {
-			b.AddPrefix(prefix)
-			count++
-		} else if addr, err := netip.ParseAddr(line); err == nil {
-			// Single IP address
-			b.Add(addr)
-			count++
-		}
 		// Skip invalid entries silently
+		if prefix, ok := parseEntry(line); ok {
+			entries.add(prefix)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	if count == 0 {
+	if len(entries) == 0 {
 		logger.Warn("EDL is empty - no IP addresses found")
 	}
 
-	ipset, err := b.IPSet()
-	if err != nil {
-		return nil, 0, err
+	return entries, nil
+}
+
+// Entries is the set of prefixes an EDL lists. The IP set used for
+// matching is built from it, so a delta can remove one entry without
+// affecting other entries that overlap it.
+type Entries map[netip.Prefix]struct{}
+
+// add adds prefix and reports whether it was not listed yet
+func (e Entries) add(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	if _, ok := e[prefix]; ok {
+		return false
+	}
+	e[prefix] = struct{}{}
+	return true
+}
+
+// remove removes prefix and reports whether it was listed
+func (e Entries) remove(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	if _, ok := e[prefix]; !ok {
+		return false
 	}
+	delete(e, prefix)
+	return true
+}
 
-	return ipset, count, nil
+// IPSet builds the IP set covering all entries
+func (e Entries) IPSet() (*netipx.IPSet, error) {
+	var b netipx.IPSetBuilder
+	for prefix := range e {
+		b.AddPrefix(prefix)
+	}
+	return b.IPSet()
 }
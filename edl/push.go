@@ -0,0 +1,207 @@
+package edl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
+)
+
+const (
+	// edlUpdatedEvent is the SSE event type announcing a new EDL version
+	edlUpdatedEvent = "edl_updated"
+
+	sseInitialBackoff = 1 * time.Second
+	sseMaxBackoff     = 2 * time.Minute
+
+	// sseIdleTimeout is how long a stream may stay silent, without events
+	// or keep-alive comments, before it is considered dead and reconnected
+	sseIdleTimeout = 90 * time.Second
+
+	// sseStableUptime is how long a stream has to stay up for the next
+	// reconnect to start over at the initial backoff
+	sseStableUptime = 1 * time.Minute
+)
+
+// Notify requests an immediate EDL update in response to a push
+// notification. Notifications arriving while one is already pending are
+// coalesced, so bursts trigger a single fetch.
+func (u *Updater) Notify(source string) {
+	metrics.EDLPushNotificationsTotal.WithLabelValues(source).Inc()
+	u.trigger(source)
+}
+
+func (u *Updater) trigger(source string) {
+	select {
+	case u.notifyCh <- source:
+	default:
+	}
+}
+
+// subscribe listens on the platform's server-sent events stream at
+// eventsURL and triggers an update whenever a new EDL version is
+// announced. The stream is reconnected with backoff until ctx is
+// cancelled; the polling loop keeps running regardless.
+func (u *Updater) subscribe(ctx context.Context, eventsURL string) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			IdleConnTimeout:       30 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+
+	reconnect := sseReconnect{base: sseInitialBackoff, backoff: sseInitialBackoff}
+	for {
+		healthy, retry, err := u.readEvents(ctx, client, eventsURL, sseIdleTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := reconnect.next(healthy, retry, err)
+		logger.Debug("EDL event stream disconnected",
+			"error", err,
+			"reconnect_in", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// sseReconnect computes the delays between event stream connections
+type sseReconnect struct {
+	// base is the delay after a healthy connection, sseInitialBackoff
+	// unless the server sent a retry field
+	base    time.Duration
+	backoff time.Duration
+}
+
+// next returns the delay before reconnecting after a connection ended.
+// The delay doubles up to sseMaxBackoff and only starts over at base once
+// a connection was healthy, so a server that accepts and immediately drops
+// connections is not hammered. A Retry-After on a rejected connection is
+// honored up to sseMaxBackoff.
+func (r *sseReconnect) next(healthy bool, retry time.Duration, err error) time.Duration {
+	if retry > 0 {
+		r.base = min(retry, sseMaxBackoff)
+	}
+	if healthy {
+		r.backoff = r.base
+	}
+
+	delay := r.backoff
+	if wait := min(retryAfter(err), sseMaxBackoff); wait > delay {
+		delay = wait
+	}
+	r.backoff = min(r.backoff*2, sseMaxBackoff)
+	return delay
+}
+
+// readEvents consumes a single SSE connection. It reports whether the
+// connection was healthy, meaning it delivered an event or stayed up for
+// sseStableUptime, and the reconnect delay requested by the server, if
+// any. A connection that stays silent for idleTimeout is closed.
+func (u *Updater) readEvents(ctx context.Context, client *http.Client, eventsURL string, idleTimeout time.Duration) (bool, time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", eventsURL, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if u.config.TokenManager != nil {
+		if token := u.config.TokenManager.GetToken(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		statusErr := &StatusError{StatusCode: resp.StatusCode, Message: string(body)}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = utils.ParseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return false, 0, statusErr
+	}
+
+	logger.Debug("Subscribed to EDL event stream", "url", eventsURL)
+	connected := time.Now()
+
+	// Every line, keep-alive comments included, pushes the deadline out
+	var idle atomic.Bool
+	deadline := time.AfterFunc(idleTimeout, func() {
+		idle.Store(true)
+		cancel()
+	})
+	defer deadline.Stop()
+
+	var retry time.Duration
+	delivered := false
+	eventType := ""
+	hasData := false
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		deadline.Reset(idleTimeout)
+		line := scanner.Text()
+
+		// A blank line dispatches the event accumulated so far
+		if line == "" {
+			if hasData {
+				delivered = true
+				if eventType == "" || eventType == edlUpdatedEvent {
+					u.Notify("sse")
+				}
+			}
+			eventType = ""
+			hasData = false
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue // comment / keep-alive
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			hasData = true
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms > 0 {
+				retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	healthy := delivered || time.Since(connected) >= sseStableUptime
+	if idle.Load() {
+		return healthy, retry, errors.New("no data on event stream for " + idleTimeout.String())
+	}
+	if err := scanner.Err(); err != nil {
+		return healthy, retry, err
+	}
+	return healthy, retry, errors.New("stream closed by server")
+}
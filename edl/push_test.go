@@ -0,0 +1,214 @@
+package edl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+func TestSSEReconnectBackoff(t *testing.T) {
+	r := sseReconnect{base: sseInitialBackoff, backoff: sseInitialBackoff}
+	steps := []struct {
+		name    string
+		healthy bool
+		retry   time.Duration
+		err     error
+		want    time.Duration
+	}{
+		{"first drop", false, 0, nil, time.Second},
+		{"dropped again", false, 0, nil, 2 * time.Second},
+		{"still dropping", false, 0, nil, 4 * time.Second},
+		{"healthy resets", true, 0, nil, time.Second},
+		{"server retry", true, 5 * time.Second, nil, 5 * time.Second},
+		{"backs off from retry", false, 0, nil, 10 * time.Second},
+		{"retry-after", false, 0, &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Minute}, time.Minute},
+		{"retry-after capped", false, 0, &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}, sseMaxBackoff},
+		{"keeps backing off", false, 0, nil, 80 * time.Second},
+		{"backoff capped", false, 0, nil, sseMaxBackoff},
+	}
+
+	for _, step := range steps {
+		if got := r.next(step.healthy, step.retry, step.err); got != step.want {
+			t.Fatalf("%s: delay = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		healthy bool
+		retry   time.Duration
+		notify  bool
+		err     string
+	}{
+		{
+			name: "event",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("retry: 3000\nevent: edl_updated\ndata: v2\n\n"))
+			},
+			healthy: true,
+			retry:   3 * time.Second,
+			notify:  true,
+			err:     "stream closed by server",
+		},
+		{
+			name: "other event",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("event: ping\ndata: {}\n\n"))
+			},
+			healthy: true,
+			err:     "stream closed by server",
+		},
+		{
+			name:    "dropped",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			err:     "stream closed by server",
+		},
+		{
+			name: "keep-alives",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 5; i++ {
+					_, _ = w.Write([]byte(": keep-alive\n"))
+					w.(http.Flusher).Flush()
+					time.Sleep(20 * time.Millisecond)
+				}
+			},
+			err: "stream closed by server",
+		},
+		{
+			name: "idle",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(": keep-alive\n"))
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			},
+			err: "no data on event stream",
+		},
+		{
+			name: "unavailable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "7")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			err: "unexpected status 503",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+
+			updater := NewUpdater(&config.Config{}, ipmatcher.New())
+			healthy, retry, err := updater.readEvents(context.Background(), ts.Client(), ts.URL, 50*time.Millisecond)
+
+			if healthy != tt.healthy {
+				t.Errorf("healthy = %v, want %v", healthy, tt.healthy)
+			}
+			if retry != tt.retry {
+				t.Errorf("retry = %v, want %v", retry, tt.retry)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+
+			notified := false
+			select {
+			case <-updater.notifyCh:
+				notified = true
+			default:
+			}
+			if notified != tt.notify {
+				t.Errorf("notified = %v, want %v", notified, tt.notify)
+			}
+		})
+	}
+}
+
+func TestReadEventsRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	updater := NewUpdater(&config.Config{}, ipmatcher.New())
+	_, _, err := updater.readEvents(context.Background(), ts.Client(), ts.URL, time.Second)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != 7*time.Second {
+		t.Fatalf("error = %v, want a StatusError with Retry-After 7s", err)
+	}
+
+	r := sseReconnect{base: sseInitialBackoff, backoff: sseInitialBackoff}
+	if got := r.next(false, 0, err); got != 7*time.Second {
+		t.Errorf("reconnect delay = %v, want 7s", got)
+	}
+}
+
+func TestSubscriptionReconnectsAndStopsWhenDisabled(t *testing.T) {
+	connected := make(chan int, 4)
+	disconnected := make(chan struct{}, 4)
+	conns := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns++
+		connected <- conns
+		if conns == 1 {
+			// The first connection announces a version and drops
+			_, _ = w.Write([]byte("data: v2\n\n"))
+			return
+		}
+		_, _ = w.Write([]byte(": keep-alive\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		disconnected <- struct{}{}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Config{DeploymentEnabled: true, EDLEventsURL: ts.URL}
+	updater := NewUpdater(cfg, ipmatcher.New())
+	updater.runCtx = ctx
+	settings := cfg.EDLSettings()
+	updater.ensureSubscribed(settings)
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case n := <-connected:
+			if n != want {
+				t.Fatalf("connection %d, want %d", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection %d", want)
+		}
+	}
+	select {
+	case source := <-updater.notifyCh:
+		if source != "sse" {
+			t.Errorf("notified by %q, want sse", source)
+		}
+	default:
+		t.Error("event did not trigger an update")
+	}
+
+	disabled := settings
+	disabled.Enabled = false
+	updater.ensureSubscribed(disabled)
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream kept open after the deployment was disabled")
+	}
+}
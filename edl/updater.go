@@ -12,8 +12,13 @@ import (
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
+	"go4.org/netipx"
 )
 
+// stalenessCheckInterval is how often the staleness metrics are refreshed
+const stalenessCheckInterval = 15 * time.Second
+
 type Updater struct {
 	fetcher     *Fetcher
 	matcher     *ipmatcher.Matcher
@@ -22,50 +27,204 @@ type Updater struct {
 	lastError   error
 	updateCount int64
 	mu          sync.RWMutex
+
+	// syncMu serializes updates and guards the delta sync state and the
+	// settings the list is fetched with. settings only changes once
+	// Reconfigure loaded the list for the new settings.
+	syncMu       sync.Mutex
+	settings     config.EDLSettings
+	entries      Entries
+	cursor       string
+	lastFullSync time.Time
+
+	// Push notifications waiting to be handled by the update loop
+	notifyCh chan string
+
+	// Context the background loops run in, set by Start
+	runCtx context.Context
+	// Event stream subscription: the URL it reads and a func stopping it,
+	// nil while not subscribed
+	eventsURL   string
+	unsubscribe context.CancelFunc
+
+	// Consecutive failed update cycles, only touched by the update loop
+	failures int
 }
 
 func NewUpdater(cfg *config.Config, matcher *ipmatcher.Matcher) *Updater {
 	return &Updater{
-		fetcher: NewFetcher(cfg),
-		matcher: matcher,
-		config:  cfg,
+		fetcher:  NewFetcher(cfg),
+		matcher:  matcher,
+		config:   cfg,
+		settings: cfg.EDLSettings(),
+		notifyCh: make(chan string, 1),
 	}
 }
 
 func (u *Updater) Start(ctx context.Context) error {
-	// Skip EDL fetching if deployment is disabled
-	if !u.config.DeploymentEnabled {
-		return nil
-	}
+	u.syncMu.Lock()
+	settings := u.settings
+	u.syncMu.Unlock()
 
-	if err := u.updateNow(ctx); err != nil {
-		return errors.New("initial EDL fetch failed: " + err.Error())
+	// The initial fetch is skipped if deployment is disabled; the loop
+	// still runs so the list is fetched once the deployment is enabled
+	if settings.Enabled {
+		if err := u.updateNow(ctx); err != nil {
+			return errors.New("initial EDL fetch failed: " + err.Error())
+		}
 	}
 
+	u.mu.Lock()
+	u.runCtx = ctx
+	u.mu.Unlock()
+
 	go u.runUpdateLoop(ctx)
+	go u.monitorStaleness(ctx)
+	u.ensureSubscribed(settings)
 	return nil
 }
 
+// Reconfigure applies changed EDL settings before they are stored in the
+// config. When the list URL or mode changes or the deployment is enabled,
+// the new list is fetched and published together with the new mode before
+// returning; if that fails, the old settings stay in effect. Other changes
+// take effect on the next scheduled update.
+func (u *Updater) Reconfigure(ctx context.Context, old, new config.EDLSettings) error {
+	u.syncMu.Lock()
+	defer u.syncMu.Unlock()
+
+	if new.Enabled && (!old.Enabled || old.URL != new.URL || old.DeltaURL != new.DeltaURL || old.Mode != new.Mode) {
+		cursor := u.cursor
+		u.cursor = ""
+		if err := u.update(ctx, new); err != nil {
+			u.cursor = cursor
+			return err
+		}
+	}
+	u.settings = new
+
+	u.ensureSubscribed(new)
+	if !new.Enabled {
+		return nil
+	}
+
+	if old.UpdateFrequency != new.UpdateFrequency {
+		u.trigger("reconfigure")
+	}
+	return nil
+}
+
+// ensureSubscribed starts the event stream subscriber once an events URL
+// is known, moves it when the URL changes and stops it while the
+// deployment is disabled
+func (u *Updater) ensureSubscribed(settings config.EDLSettings) {
+	eventsURL := settings.EventsURL
+	if !settings.Enabled {
+		eventsURL = ""
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.runCtx == nil || (u.unsubscribe != nil && u.eventsURL == eventsURL) {
+		return
+	}
+	if u.unsubscribe != nil {
+		u.unsubscribe()
+		u.unsubscribe = nil
+	}
+	u.eventsURL = eventsURL
+	if eventsURL == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(u.runCtx)
+	u.unsubscribe = cancel
+	go u.subscribe(ctx, eventsURL)
+}
+
 func (u *Updater) runUpdateLoop(ctx context.Context) {
-	ticker := time.NewTicker(u.config.UpdateFrequency)
-	defer ticker.Stop()
+	timer := time.NewTimer(u.nextDelay(nil))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			if err := u.updateNow(ctx); err != nil {
-				logger.Error("EDL update failed", "error", err)
+		case <-timer.C:
+		case source := <-u.notifyCh:
+			logger.Debug("EDL update triggered", "source", source)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
 		}
+
+		err := u.updateNow(ctx)
+		if err != nil {
+			logger.Error("EDL update failed", "error", err)
+		}
+		timer.Reset(u.nextDelay(err))
+	}
+}
+
+// nextDelay schedules the next update. Successful cycles wait a jittered
+// UpdateFrequency so replicas drift apart; failed cycles back off
+// exponentially up to MaxUpdateBackoff. A server-requested Retry-After is
+// honored up to the same limit, so a bad header cannot stall updates.
+func (u *Updater) nextDelay(lastErr error) time.Duration {
+	var delay time.Duration
+	frequency := u.config.EDLSettings().UpdateFrequency
+
+	if lastErr == nil {
+		u.failures = 0
+		delay = utils.Jitter(frequency, u.config.UpdateJitter)
+	} else {
+		u.failures++
+		maxBackoff := u.config.MaxUpdateBackoff
+		if maxBackoff < frequency {
+			maxBackoff = frequency
+		}
+		delay = utils.Jitter(utils.Backoff(frequency, maxBackoff, u.failures-1), u.config.UpdateJitter)
+		if wait := min(retryAfter(lastErr), maxBackoff); wait > delay {
+			delay = wait
+		}
 	}
+
+	metrics.EDLNextUpdateTimestamp.Set(float64(time.Now().Add(delay).Unix()))
+	return delay
 }
 
 func (u *Updater) updateNow(ctx context.Context) error {
+	u.syncMu.Lock()
+	defer u.syncMu.Unlock()
+	return u.update(ctx, u.settings)
+}
+
+// update fetches the list for settings and publishes it with the mode of
+// settings. Callers must hold syncMu.
+func (u *Updater) update(ctx context.Context, settings config.EDLSettings) error {
+	if !settings.Enabled {
+		return nil
+	}
+
 	start := time.Now()
 
-	ipset, count, err := u.fetcher.FetchWithRetry(ctx)
+	var ipset *netipx.IPSet
+	var count int64
+	var err error
+
+	if u.deltaSyncDue(settings) {
+		ipset, count, err = u.applyDelta(ctx, settings.DeltaURL)
+		if errors.Is(err, ErrCursorRejected) {
+			logger.Info("EDL delta cursor rejected, falling back to full fetch")
+			ipset, count, err = u.fullSync(ctx, settings.URL)
+		}
+	} else {
+		ipset, count, err = u.fullSync(ctx, settings.URL)
+	}
+
 	if err != nil {
 		u.mu.Lock()
 		u.lastError = err
@@ -74,7 +233,7 @@ func (u *Updater) updateNow(ctx context.Context) error {
 		return err
 	}
 
-	u.matcher.Update(ipset, count)
+	u.matcher.UpdateList(ipset, count, settings.Mode)
 
 	u.mu.Lock()
 	u.lastUpdate = time.Now()
@@ -104,6 +263,116 @@ func (u *Updater) updateNow(ctx context.Context) error {
 	return nil
 }
 
+// deltaSyncDue reports whether the next update can use the delta feed
+// instead of downloading the full list
+func (u *Updater) deltaSyncDue(settings config.EDLSettings) bool {
+	if settings.DeltaURL == "" || u.cursor == "" {
+		return false
+	}
+	return time.Since(u.lastFullSync) < u.config.FullResyncInterval
+}
+
+func (u *Updater) fullSync(ctx context.Context, url string) (*netipx.IPSet, int64, error) {
+	entries, cursor, err := u.fetcher.FetchWithRetry(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ipset, err := entries.IPSet()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	u.entries = entries
+	u.cursor = cursor
+	u.lastFullSync = time.Now()
+	return ipset, int64(len(entries)), nil
+}
+
+func (u *Updater) applyDelta(ctx context.Context, deltaURL string) (*netipx.IPSet, int64, error) {
+	delta, err := u.fetcher.FetchDeltaWithRetry(ctx, deltaURL, u.cursor)
+	if err != nil {
+		if errors.Is(err, ErrCursorRejected) {
+			metrics.EDLDeltaUpdatesTotal.WithLabelValues("rejected").Inc()
+			u.cursor = ""
+		} else {
+			metrics.EDLDeltaUpdatesTotal.WithLabelValues("failure").Inc()
+		}
+		return nil, 0, err
+	}
+
+	// The set is rebuilt from the entries, since the merged set no longer
+	// knows which entries overlapping prefixes came from
+	change := delta.Apply(u.entries)
+	ipset, err := u.entries.IPSet()
+	if err != nil {
+		// The entries may no longer match the cursor; start over with a
+		// full fetch
+		u.cursor = ""
+		metrics.EDLDeltaUpdatesTotal.WithLabelValues("failure").Inc()
+		return nil, 0, err
+	}
+
+	u.cursor = delta.Cursor
+	metrics.EDLDeltaUpdatesTotal.WithLabelValues("success").Inc()
+	logger.Debug("EDL delta applied",
+		"added", len(delta.Added),
+		"removed", len(delta.Removed),
+		"change", change)
+
+	return ipset, int64(len(u.entries)), nil
+}
+
+// LastUpdate returns the time of the last successful update
+func (u *Updater) LastUpdate() time.Time {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.lastUpdate
+}
+
+// Staleness returns the age of the loaded EDL and whether it exceeds the
+// configured max age. An EDL that was never loaded is stale.
+func (u *Updater) Staleness() (time.Duration, bool) {
+	lastUpdate := u.LastUpdate()
+	if lastUpdate.IsZero() {
+		return 0, true
+	}
+
+	age := time.Since(lastUpdate)
+	return age, age > u.MaxAge()
+}
+
+// MaxAge returns how old the EDL may get before it is stale
+func (u *Updater) MaxAge() time.Duration {
+	return u.config.MaxEDLAge()
+}
+
+// monitorStaleness keeps the staleness gauges current between updates
+func (u *Updater) monitorStaleness(ctx context.Context) {
+	ticker := time.NewTicker(stalenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if u.config.EDLSettings().Enabled {
+			age, stale := u.Staleness()
+			metrics.EDLAgeSeconds.Set(age.Seconds())
+			if stale {
+				metrics.EDLStale.Set(1)
+			} else {
+				metrics.EDLStale.Set(0)
+			}
+		} else {
+			metrics.EDLStale.Set(0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (u *Updater) GetStatus() (time.Time, error, int64, int64) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
@@ -0,0 +1,419 @@
+package edl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+// edlServer stands in for the platform's full list and delta feed
+type edlServer struct {
+	mu         sync.Mutex
+	full       string
+	fullCursor string
+	// deltas maps a cursor to the delta body served for it
+	deltas      map[string]string
+	deltaCursor string
+	// deltaStatus, when set, is returned instead of a delta
+	deltaStatus int
+	fullHits    int
+	deltaHits   int
+	// allow is a second list, served with allowStatus when that is set
+	allow       string
+	allowStatus int
+	allowHits   int
+	// fullGate, when set, holds full list responses until it is closed
+	fullGate chan struct{}
+}
+
+func (s *edlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/full":
+		s.fullHits++
+		if gate := s.fullGate; gate != nil {
+			s.mu.Unlock()
+			<-gate
+			s.mu.Lock()
+		}
+		w.Header().Set(cursorHeader, s.fullCursor)
+		_, _ = w.Write([]byte(s.full))
+	case "/allow":
+		s.allowHits++
+		if s.allowStatus != 0 {
+			w.WriteHeader(s.allowStatus)
+			return
+		}
+		_, _ = w.Write([]byte(s.allow))
+	case "/delta":
+		s.deltaHits++
+		if s.deltaStatus != 0 {
+			w.WriteHeader(s.deltaStatus)
+			return
+		}
+		body, ok := s.deltas[r.URL.Query().Get("cursor")]
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.Header().Set(cursorHeader, s.deltaCursor)
+		_, _ = w.Write([]byte(body))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestUpdater(t *testing.T, srv *edlServer) (*Updater, *ipmatcher.Matcher) {
+	t.Helper()
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	cfg := &config.Config{
+		DeploymentEnabled:  true,
+		EDLMode:            "blocklist",
+		EDLURL:             ts.URL + "/full",
+		EDLDeltaURL:        ts.URL + "/delta",
+		UpdateFrequency:    time.Minute,
+		MaxRetryAttempts:   1,
+		RetryDelay:         time.Millisecond,
+		FullResyncInterval: time.Hour,
+	}
+	matcher := ipmatcher.New()
+	return NewUpdater(cfg, matcher), matcher
+}
+
+func assertContains(t *testing.T, matcher *ipmatcher.Matcher, ip string, want bool) {
+	t.Helper()
+	if got := matcher.Contains(netip.MustParseAddr(ip)); got != want {
+		t.Errorf("Contains(%s) = %v, want %v", ip, got, want)
+	}
+}
+
+func TestUpdaterAppliesDelta(t *testing.T) {
+	srv := &edlServer{
+		full:       "192.0.2.1\n192.0.2.2\n",
+		fullCursor: "c1",
+		// Re-adds an existing entry and removes an absent one, which must
+		// not change the count
+		deltas:      map[string]string{"c1": "+198.51.100.1\n-192.0.2.1\n+192.0.2.2\n-203.0.113.1\n"},
+		deltaCursor: "c2",
+	}
+	updater, matcher := newTestUpdater(t, srv)
+	ctx := context.Background()
+
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatalf("full sync: %v", err)
+	}
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatalf("delta sync: %v", err)
+	}
+
+	if srv.fullHits != 1 || srv.deltaHits != 1 {
+		t.Errorf("full hits = %d, delta hits = %d, want 1 and 1", srv.fullHits, srv.deltaHits)
+	}
+	if updater.cursor != "c2" {
+		t.Errorf("cursor = %q, want c2", updater.cursor)
+	}
+	assertContains(t, matcher, "192.0.2.1", false)
+	assertContains(t, matcher, "192.0.2.2", true)
+	assertContains(t, matcher, "198.51.100.1", true)
+	if got := matcher.Count(); got != 2 {
+		t.Errorf("Count() = %d, want 2", got)
+	}
+}
+
+func TestUpdaterFallsBackToFullSyncOnRejectedCursor(t *testing.T) {
+	for _, status := range []int{http.StatusGone, http.StatusConflict} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			srv := &edlServer{
+				full:        "192.0.2.1\n",
+				fullCursor:  "c1",
+				deltaStatus: status,
+			}
+			updater, matcher := newTestUpdater(t, srv)
+			ctx := context.Background()
+
+			if err := updater.updateNow(ctx); err != nil {
+				t.Fatalf("full sync: %v", err)
+			}
+
+			srv.mu.Lock()
+			srv.full = "198.51.100.1\n198.51.100.2\n"
+			srv.fullCursor = "c5"
+			srv.mu.Unlock()
+
+			if err := updater.updateNow(ctx); err != nil {
+				t.Fatalf("fallback sync: %v", err)
+			}
+
+			if srv.fullHits != 2 || srv.deltaHits != 1 {
+				t.Errorf("full hits = %d, delta hits = %d, want 2 and 1", srv.fullHits, srv.deltaHits)
+			}
+			if updater.cursor != "c5" {
+				t.Errorf("cursor = %q, want c5", updater.cursor)
+			}
+			assertContains(t, matcher, "192.0.2.1", false)
+			assertContains(t, matcher, "198.51.100.2", true)
+			if got := matcher.Count(); got != 2 {
+				t.Errorf("Count() = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestUpdaterNotModifiedDeltaKeepsList(t *testing.T) {
+	srv := &edlServer{
+		full:        "192.0.2.1\n",
+		fullCursor:  "c1",
+		deltaStatus: http.StatusNotModified,
+	}
+	updater, matcher := newTestUpdater(t, srv)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := updater.updateNow(ctx); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+	}
+
+	if srv.fullHits != 1 || srv.deltaHits != 1 {
+		t.Errorf("full hits = %d, delta hits = %d, want 1 and 1", srv.fullHits, srv.deltaHits)
+	}
+	if updater.cursor != "c1" {
+		t.Errorf("cursor = %q, want c1", updater.cursor)
+	}
+	assertContains(t, matcher, "192.0.2.1", true)
+	if got := matcher.Count(); got != 1 {
+		t.Errorf("Count() = %d, want 1", got)
+	}
+}
+
+func TestUpdaterFullResyncAfterInterval(t *testing.T) {
+	srv := &edlServer{
+		full:       "192.0.2.1\n",
+		fullCursor: "c1",
+		deltas:     map[string]string{"c1": "+198.51.100.1\n"},
+	}
+	updater, _ := newTestUpdater(t, srv)
+	ctx := context.Background()
+
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	updater.lastFullSync = time.Now().Add(-2 * time.Hour)
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.fullHits != 2 || srv.deltaHits != 0 {
+		t.Errorf("full hits = %d, delta hits = %d, want 2 and 0", srv.fullHits, srv.deltaHits)
+	}
+}
+
+// allowlistSettings switches the test updater's settings to the allow list
+func allowlistSettings(old config.EDLSettings) config.EDLSettings {
+	new := old
+	new.Mode = "allowlist"
+	new.URL = strings.TrimSuffix(old.URL, "/full") + "/allow"
+	new.DeltaURL = ""
+	return new
+}
+
+func (s *edlServer) hits() (full, allow int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fullHits, s.allowHits
+}
+
+func TestReconfigureDuringUpdatePublishesModeWithList(t *testing.T) {
+	gate := make(chan struct{})
+	srv := &edlServer{
+		full:     "192.0.2.1\n",
+		allow:    "198.51.100.1\n",
+		fullGate: gate,
+	}
+	updater, matcher := newTestUpdater(t, srv)
+	ctx := context.Background()
+	old := updater.config.EDLSettings()
+	new := allowlistSettings(old)
+
+	// Every published list must be judged with its own mode: the blocklist
+	// never holds 198.51.100.1 and the allowlist never holds 192.0.2.1
+	done := make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if in, mode := matcher.Lookup(netip.MustParseAddr("192.0.2.1")); in && mode != "blocklist" {
+				t.Errorf("192.0.2.1 listed with mode %q", mode)
+				return
+			}
+			if in, mode := matcher.Lookup(netip.MustParseAddr("198.51.100.1")); in && mode != "allowlist" {
+				t.Errorf("198.51.100.1 listed with mode %q", mode)
+				return
+			}
+		}
+	}()
+
+	// A scheduled update with the old settings is in flight when the
+	// platform switches the deployment to an allowlist
+	updated := make(chan error, 1)
+	go func() { updated <- updater.updateNow(ctx) }()
+	for full, _ := srv.hits(); full == 0; full, _ = srv.hits() {
+		time.Sleep(time.Millisecond)
+	}
+	reconfigured := make(chan error, 1)
+	go func() { reconfigured <- updater.Reconfigure(ctx, old, new) }()
+
+	close(gate)
+	if err := <-updated; err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := <-reconfigured; err != nil {
+		t.Fatalf("reconfigure: %v", err)
+	}
+	close(done)
+	<-checked
+
+	if mode := matcher.Mode(); mode != "allowlist" {
+		t.Errorf("Mode() = %q, want allowlist", mode)
+	}
+	assertContains(t, matcher, "198.51.100.1", true)
+	assertContains(t, matcher, "192.0.2.1", false)
+
+	// Later updates use the new settings even before the config has them
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if full, allow := srv.hits(); full != 1 || allow != 2 {
+		t.Errorf("full hits = %d, allow hits = %d, want 1 and 2", full, allow)
+	}
+}
+
+func TestFailedReconfigureKeepsListAndMode(t *testing.T) {
+	srv := &edlServer{
+		full:        "192.0.2.1\n",
+		allowStatus: http.StatusInternalServerError,
+	}
+	updater, matcher := newTestUpdater(t, srv)
+	ctx := context.Background()
+
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := updater.config.EDLSettings()
+	if err := updater.Reconfigure(ctx, old, allowlistSettings(old)); err == nil {
+		t.Fatal("Reconfigure succeeded despite failing fetch")
+	}
+
+	if mode := matcher.Mode(); mode != "blocklist" {
+		t.Errorf("Mode() = %q, want blocklist", mode)
+	}
+	assertContains(t, matcher, "192.0.2.1", true)
+
+	if err := updater.updateNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if full, _ := srv.hits(); full != 2 {
+		t.Errorf("full hits = %d, want 2 with the old settings", full)
+	}
+}
+
+func TestReenabledDeploymentLoadsList(t *testing.T) {
+	srv := &edlServer{full: "192.0.2.1\n"}
+	updater, matcher := newTestUpdater(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	enabled := updater.config.EDLSettings()
+	disabled := enabled
+	disabled.Enabled = false
+	disabled.Mode = "disabled"
+	updater.settings = disabled
+
+	// A disabled deployment starts without fetching
+	if err := updater.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if full, _ := srv.hits(); full != 0 {
+		t.Fatalf("full hits = %d while disabled, want 0", full)
+	}
+
+	if err := updater.Reconfigure(ctx, disabled, enabled); err != nil {
+		t.Fatal(err)
+	}
+	if full, _ := srv.hits(); full != 1 {
+		t.Errorf("full hits = %d, want 1", full)
+	}
+	if mode := matcher.Mode(); mode != "blocklist" {
+		t.Errorf("Mode() = %q, want blocklist", mode)
+	}
+	assertContains(t, matcher, "192.0.2.1", true)
+}
+
+func TestNextDelayCapsRetryAfter(t *testing.T) {
+	cfg := &config.Config{
+		DeploymentEnabled: true,
+		UpdateFrequency:   5 * time.Minute,
+		MaxUpdateBackoff:  30 * time.Minute,
+	}
+	updater := NewUpdater(cfg, ipmatcher.New())
+
+	tests := []struct {
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{retryAfter: 10 * time.Minute, want: 10 * time.Minute},
+		{retryAfter: 72 * time.Hour, want: 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		updater.failures = 0
+		got := updater.nextDelay(&StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: tt.retryAfter})
+		if got != tt.want {
+			t.Errorf("nextDelay with Retry-After %v = %v, want %v", tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestUpdaterDeltaKeepsOverlappingEntries(t *testing.T) {
+	srv := &edlServer{
+		full:        "10.0.0.0/8\n10.0.0.5\n",
+		fullCursor:  "c1",
+		deltas:      map[string]string{"c1": "-10.0.0.5\n+192.0.2.1\n"},
+		deltaCursor: "c2",
+	}
+	updater, matcher := newTestUpdater(t, srv)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := updater.updateNow(ctx); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+	}
+
+	if srv.deltaHits != 1 {
+		t.Errorf("delta hits = %d, want 1", srv.deltaHits)
+	}
+	assertContains(t, matcher, "10.0.0.5", true)
+	assertContains(t, matcher, "192.0.2.1", true)
+	if got := matcher.Count(); got != 2 {
+		t.Errorf("Count() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,78 @@
+package edl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+)
+
+// maxWebhookBody caps how much of a webhook request body is read
+const maxWebhookBody = 64 * 1024
+
+// WebhookHandler accepts inbound notifications that a new EDL version is
+// available and triggers an immediate update
+type WebhookHandler struct {
+	updater *Updater
+	secret  []byte
+}
+
+func NewWebhookHandler(updater *Updater, secret string) *WebhookHandler {
+	return &WebhookHandler{
+		updater: updater,
+		secret:  []byte(secret),
+	}
+}
+
+// ServeHTTP authenticates the request either with the shared secret as a
+// bearer token, or with an X-ELLIO-Signature header carrying the hex
+// HMAC-SHA256 of the body ("sha256=<hex>").
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.authenticate(r, body) {
+		logger.Warn("Rejected unauthenticated EDL webhook", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.updater.Notify("webhook")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *WebhookHandler) authenticate(r *http.Request, body []byte) bool {
+	if len(h.secret) == 0 {
+		return false
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return subtle.ConstantTimeCompare([]byte(token), h.secret) == 1
+	}
+
+	if signature, ok := strings.CutPrefix(r.Header.Get("X-ELLIO-Signature"), "sha256="); ok {
+		expected, err := hex.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		return hmac.Equal(mac.Sum(nil), expected)
+	}
+
+	return false
+}
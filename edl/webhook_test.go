@@ -0,0 +1,71 @@
+package edl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+func signature(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookHandler(t *testing.T) {
+	const body = `{"version":2}`
+	tests := []struct {
+		name   string
+		secret string
+		method string
+		header string
+		value  string
+		want   int
+	}{
+		{"bearer", "s3cret", http.MethodPost, "Authorization", "Bearer s3cret", http.StatusAccepted},
+		{"signature", "s3cret", http.MethodPost, "X-ELLIO-Signature", signature("s3cret", body), http.StatusAccepted},
+		{"wrong bearer", "s3cret", http.MethodPost, "Authorization", "Bearer guess", http.StatusUnauthorized},
+		{"wrong signature", "s3cret", http.MethodPost, "X-ELLIO-Signature", signature("guess", body), http.StatusUnauthorized},
+		{"signature of other body", "s3cret", http.MethodPost, "X-ELLIO-Signature", signature("s3cret", "{}"), http.StatusUnauthorized},
+		{"malformed signature", "s3cret", http.MethodPost, "X-ELLIO-Signature", "sha256=zz", http.StatusUnauthorized},
+		{"unprefixed signature", "s3cret", http.MethodPost, "X-ELLIO-Signature", strings.TrimPrefix(signature("s3cret", body), "sha256="), http.StatusUnauthorized},
+		{"no credentials", "s3cret", http.MethodPost, "", "", http.StatusUnauthorized},
+		{"no secret configured", "", http.MethodPost, "Authorization", "Bearer ", http.StatusUnauthorized},
+		{"wrong method", "s3cret", http.MethodGet, "Authorization", "Bearer s3cret", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updater := NewUpdater(&config.Config{}, ipmatcher.New())
+			handler := NewWebhookHandler(updater, tt.secret)
+
+			r := httptest.NewRequest(tt.method, "/webhooks/edl", strings.NewReader(body))
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+
+			notified := false
+			select {
+			case <-updater.notifyCh:
+				notified = true
+			default:
+			}
+			if want := tt.want == http.StatusAccepted; notified != want {
+				t.Errorf("notified = %v, want %v", notified, want)
+			}
+		})
+	}
+}
@@ -3,16 +3,19 @@ module github.com/ELLIO-Technology/ellio_traefik_forward_auth
 go 1.23.0
 
 require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/getsentry/sentry-go v0.35.1
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/keygen-sh/machineid v1.1.1
+	github.com/klauspost/compress v1.18.0
 	github.com/prometheus/client_golang v1.23.0
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba
+	golang.org/x/sync v0.16.0
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/getsentry/sentry-go v0.35.1 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.65.0 // indirect
@@ -7,10 +7,18 @@ import (
 	"go4.org/netipx"
 )
 
+// list is an IP set together with the EDL mode it was loaded for. Both
+// are swapped as one value, so a lookup never sees one list's entries
+// with another list's mode.
+type list struct {
+	ipset *netipx.IPSet
+	count int64
+	mode  string
+}
+
 // Matcher provides thread-safe IP address matching against an IP set
 type Matcher struct {
-	ipset atomic.Value // stores *netipx.IPSet
-	count atomic.Int64
+	list atomic.Pointer[list]
 }
 
 // New creates a new IP matcher
@@ -18,23 +26,43 @@ func New() *Matcher {
 	m := &Matcher{}
 	// Initialize with empty IPSet
 	empty, _ := (&netipx.IPSetBuilder{}).IPSet()
-	m.ipset.Store(empty)
+	m.list.Store(&list{ipset: empty})
 	return m
 }
 
 // Contains checks if the given IP address is in the set
 func (m *Matcher) Contains(ip netip.Addr) bool {
-	set := m.ipset.Load().(*netipx.IPSet)
-	return set.Contains(ip)
+	return m.list.Load().ipset.Contains(ip)
+}
+
+// Lookup reports whether ip is in the set and the mode of the set it was
+// checked against. The mode is "" until a list was loaded with one.
+func (m *Matcher) Lookup(ip netip.Addr) (bool, string) {
+	l := m.list.Load()
+	return l.ipset.Contains(ip), l.mode
+}
+
+// IPSet returns the current IP set
+func (m *Matcher) IPSet() *netipx.IPSet {
+	return m.list.Load().ipset
 }
 
-// Update atomically replaces the IP set with a new one
+// Update atomically replaces the IP set with a new one, keeping the mode
 func (m *Matcher) Update(ipset *netipx.IPSet, count int64) {
-	m.ipset.Store(ipset)
-	m.count.Store(count)
+	m.UpdateList(ipset, count, m.Mode())
+}
+
+// UpdateList atomically replaces the IP set and the mode it applies to
+func (m *Matcher) UpdateList(ipset *netipx.IPSet, count int64, mode string) {
+	m.list.Store(&list{ipset: ipset, count: count, mode: mode})
 }
 
 // Count returns the number of entries in the current IP set
 func (m *Matcher) Count() int64 {
-	return m.count.Load()
-}
\ No newline at end of file
+	return m.list.Load().count
+}
+
+// Mode returns the EDL mode of the current IP set, or "" if none was set
+func (m *Matcher) Mode() string {
+	return m.list.Load().mode
+}
@@ -0,0 +1,236 @@
+//go:build !windows
+
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+)
+
+const (
+	// envInheritedFDs maps server names to inherited descriptors on
+	// handoff, e.g. "auth=3,metrics=4"
+	envInheritedFDs = "ELLIO_INHERITED_FDS"
+	// envReadyFD is the pipe a handed-off child writes to once serving
+	envReadyFD = "ELLIO_READY_FD"
+
+	// sdListenFDsStart is the first descriptor passed by systemd
+	sdListenFDsStart = 3
+)
+
+// HandoffSignal triggers a zero-downtime re-exec
+var HandoffSignal os.Signal = syscall.SIGUSR2
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string]*os.File
+	// handedOver is set when the sockets came from a parent process
+	// rather than from systemd
+	handedOver bool
+)
+
+// inheritedListener returns the inherited socket for name, or nil
+func inheritedListener(name string) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		inherited, handedOver = parseInherited()
+	})
+
+	f, ok := inherited[name]
+	if !ok {
+		return nil, nil
+	}
+	delete(inherited, name)
+
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, errors.New("failed to use inherited socket for " + name + ": " + err.Error())
+	}
+
+	// A socket handed over by a parent is ours to remove on final
+	// shutdown, like one we bound ourselves. Socket paths of systemd
+	// socket units belong to systemd and are left alone.
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(handedOver)
+	}
+	return l, nil
+}
+
+// parseInherited reads the descriptors passed by a parent process or by
+// systemd, and reports whether they came from a parent. The variables are
+// cleared so they don't leak into children.
+func parseInherited() (map[string]*os.File, bool) {
+	files := map[string]*os.File{}
+
+	if spec := os.Getenv(envInheritedFDs); spec != "" {
+		os.Unsetenv(envInheritedFDs)
+		for _, entry := range strings.Split(spec, ",") {
+			name, fdStr, ok := strings.Cut(entry, "=")
+			fd, err := strconv.Atoi(fdStr)
+			if !ok || err != nil {
+				logger.Warn("Ignoring invalid inherited descriptor", "entry", entry)
+				continue
+			}
+			files[name] = os.NewFile(uintptr(fd), name)
+		}
+		return files, true
+	}
+
+	// systemd socket activation; sockets are matched by FileDescriptorName,
+	// or assigned to auth and metrics in order when unnamed
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || count <= 0 {
+		return files, false
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	defaults := []string{"auth", "metrics"}
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		} else if i < len(defaults) {
+			name = defaults[i]
+		} else {
+			continue
+		}
+		fd := sdListenFDsStart + i
+		syscall.CloseOnExec(fd)
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return files, false
+}
+
+// NotifyReady tells the parent process that handed over the sockets that
+// this process is serving, so the parent can start draining
+func NotifyReady() {
+	fdStr := os.Getenv(envReadyFD)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, _ = f.Write([]byte{1})
+}
+
+// Reexec starts a new instance of the current binary that inherits the
+// listening sockets and waits until it reports ready. The caller then
+// shuts down while the new process keeps accepting on the same sockets.
+func Reexec(ctx context.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	names, ls := registered()
+	if len(ls) == 0 {
+		return errors.New("no listeners to hand over")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var spec []string
+	for i, l := range ls {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("listener " + names[i] + " cannot be handed over")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		spec = append(spec, names[i]+"="+strconv.Itoa(sdListenFDsStart+i))
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envInheritedFDs+"=") && !strings.HasPrefix(kv, envReadyFD+"=") &&
+			!strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envInheritedFDs+"="+strings.Join(spec, ","),
+		envReadyFD+"="+strconv.Itoa(sdListenFDsStart+len(ls)))
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return errors.New("failed to start new process: " + err.Error())
+	}
+	logger.Info("Started new process for handoff", "pid", cmd.Process.Pid)
+
+	// Our copy of the write end must be closed, so a child that exits
+	// before reporting ready ends the read below
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			ready <- errors.New("new process exited before becoming ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+		} else {
+			// The child outlives us; release it so it is not waited on
+			_ = cmd.Process.Release()
+
+			// The socket files now belong to the new process
+			for _, l := range ls {
+				if ul, ok := l.(*net.UnixListener); ok {
+					ul.SetUnlinkOnClose(false)
+				}
+			}
+		}
+		return err
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return errors.New("timeout waiting for new process to become ready")
+	}
+}
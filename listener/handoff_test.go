@@ -0,0 +1,122 @@
+//go:build !windows
+
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// inherit passes l to the next Listen call for name as if it had been
+// handed over by a parent process
+func inherit(t *testing.T, name string, l net.Listener) {
+	t.Helper()
+
+	f, err := l.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	// The parent keeps its socket file for the child
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	l.Close()
+
+	t.Setenv(envInheritedFDs, name+"="+strconv.Itoa(int(f.Fd())))
+	inheritOnce = sync.Once{}
+	t.Cleanup(func() {
+		inheritOnce = sync.Once{}
+		inherited = nil
+		mu.Lock()
+		delete(listeners, name)
+		mu.Unlock()
+	})
+}
+
+func TestListenUsesInheritedTCPSocket(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := parent.Addr().String()
+	inherit(t, "auth", parent)
+
+	// The configured address is ignored in favor of the inherited socket
+	l, err := Listen("auth", "127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if got := l.Addr().String(); got != addr {
+		t.Errorf("listening on %s, want inherited %s", got, addr)
+	}
+	if _, ok := os.LookupEnv(envInheritedFDs); ok {
+		t.Errorf("%s not cleared", envInheritedFDs)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("inherited socket not accepting: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenUsesInheritedUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.sock")
+	parent, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherit(t, "auth", parent)
+
+	l, err := Listen("auth", unixPrefix+filepath.Join(t.TempDir(), "other.sock"), 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Addr().String(); got != path {
+		t.Errorf("listening on %s, want inherited %s", got, path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("inherited socket not accepting: %v", err)
+	}
+	conn.Close()
+
+	// The last process to serve the socket removes it on shutdown
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after close: %v", err)
+	}
+}
+
+func TestListenWithoutInheritedSocket(t *testing.T) {
+	t.Setenv(envInheritedFDs, "")
+	inheritOnce = sync.Once{}
+	t.Cleanup(func() {
+		inheritOnce = sync.Once{}
+		inherited = nil
+		mu.Lock()
+		delete(listeners, "metrics")
+		mu.Unlock()
+	})
+
+	l, err := Listen("metrics", "127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, ls := registered(); len(ls) != 1 || ls[0] != l {
+		t.Errorf("registered listeners = %v, want the new listener", ls)
+	}
+}
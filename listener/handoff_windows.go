@@ -0,0 +1,25 @@
+//go:build windows
+
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+)
+
+// HandoffSignal is nil on Windows, where socket handoff is not supported
+var HandoffSignal os.Signal
+
+func inheritedListener(string) (net.Listener, error) {
+	return nil, nil
+}
+
+// NotifyReady is a no-op on Windows
+func NotifyReady() {}
+
+// Reexec is not supported on Windows
+func Reexec(context.Context) error {
+	return errors.New("socket handoff is not supported on windows")
+}
@@ -0,0 +1,106 @@
+// Package listener opens the server sockets, reusing sockets inherited
+// from systemd socket activation or from a parent process handing over
+// during a zero-downtime restart.
+package listener
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+)
+
+var (
+	mu        sync.Mutex
+	listeners = map[string]net.Listener{}
+)
+
+// unixPrefix marks a listen address as a Unix domain socket path
+const unixPrefix = "unix:"
+
+// Listen returns the listener for the named server ("auth" or "metrics").
+// An inherited socket is used if one was passed for name; otherwise a new
+// socket is bound to addr, which is either host:port or unix:/path. Unix
+// sockets are created with socketMode and removed when closed.
+func Listen(name, addr string, socketMode os.FileMode) (net.Listener, error) {
+	l, err := inheritedListener(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if l != nil {
+		logger.Info("Using inherited listener", "server", name, "address", l.Addr().String())
+	} else if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		l, err = listenUnix(path, socketMode)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mu.Lock()
+	listeners[name] = l
+	mu.Unlock()
+
+	return l, nil
+}
+
+// listenUnix binds a Unix domain socket at path, replacing a stale socket
+// left behind by a process that did not shut down cleanly
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New(path + " is in use by another process")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var l net.Listener
+	err := withUmask(mode, func() (err error) {
+		l, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, errors.New("failed to set socket permissions: " + err.Error())
+	}
+	return l, nil
+}
+
+// registered returns the names and listeners opened by Listen, in a
+// stable order
+func registered() ([]string, []net.Listener) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]net.Listener, len(names))
+	for i, name := range names {
+		result[i] = listeners[name]
+	}
+	return names, result
+}
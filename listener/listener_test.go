@@ -0,0 +1,44 @@
+//go:build !windows
+
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixSocketMode(t *testing.T) {
+	// A permissive umask would leave the socket world-accessible until the
+	// chmod if it were not created under the requested mode
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	var created os.FileMode
+	path := filepath.Join(t.TempDir(), "auth.sock")
+	err := withUmask(0o660, func() error {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		created = info.Mode().Perm()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 0o660 {
+		t.Errorf("socket created with mode %o, want 660", created)
+	}
+
+	if current := syscall.Umask(0); current != 0 {
+		t.Errorf("umask not restored: %o", current)
+	}
+}
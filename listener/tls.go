@@ -0,0 +1,151 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+)
+
+// TLSFiles names the PEM files used to serve TLS. ClientCAFile is optional;
+// when set, clients must present a certificate signed by one of its CAs.
+type TLSFiles struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Enabled reports whether any TLS file is configured. A partial
+// configuration counts as enabled so NewTLSReloader rejects it instead of
+// the server silently falling back to plain HTTP.
+func (f TLSFiles) Enabled() bool {
+	return f.CertFile != "" || f.KeyFile != "" || f.ClientCAFile != ""
+}
+
+// TLSReloader serves TLS from files and reloads them when they change, so
+// renewed certificates are picked up without a restart
+type TLSReloader struct {
+	files TLSFiles
+
+	mu      sync.RWMutex
+	config  *tls.Config
+	modTime time.Time
+}
+
+// NewTLSReloader loads the files and fails if they are unusable
+func NewTLSReloader(files TLSFiles) (*TLSReloader, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required for TLS")
+	}
+
+	r := &TLSReloader{files: files}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Listener wraps l so connections are served over TLS with the current
+// certificate
+func (r *TLSReloader) Listener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	})
+}
+
+// Watch checks the files for changes every interval until ctx is done. A
+// file that fails to load keeps the previous configuration in use.
+func (r *TLSReloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+				if err := r.reload(); err != nil {
+					logger.Error("Failed to reload TLS files, keeping current certificate",
+						"cert_file", r.files.CertFile,
+						"error", err)
+				}
+			}
+		}
+	}()
+}
+
+// latestModTime returns the newest modification time of the files
+func (r *TLSReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *TLSReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.latestModTime().Equal(r.modTime)
+}
+
+func (r *TLSReloader) reload() error {
+	modTime := r.latestModTime()
+
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return errors.New("failed to load TLS certificate: " + err.Error())
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.files.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return errors.New("failed to read client CA file: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA file contains no certificates")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	r.config = config
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	logger.Info("TLS certificate loaded",
+		"cert_file", r.files.CertFile,
+		"client_auth", r.files.ClientCAFile != "")
+	return nil
+}
@@ -0,0 +1,23 @@
+package listener
+
+import "testing"
+
+func TestPartialTLSFilesRejected(t *testing.T) {
+	for _, files := range []TLSFiles{
+		{ClientCAFile: "ca.pem"},
+		{CertFile: "cert.pem"},
+		{KeyFile: "key.pem", ClientCAFile: "ca.pem"},
+	} {
+		if !files.Enabled() {
+			t.Errorf("%+v: Enabled() = false, want true", files)
+			continue
+		}
+		if _, err := NewTLSReloader(files); err == nil {
+			t.Errorf("%+v: NewTLSReloader succeeded, want an error", files)
+		}
+	}
+
+	if (TLSFiles{}).Enabled() {
+		t.Error("empty TLSFiles reported as enabled")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package listener
+
+import (
+	"os"
+	"syscall"
+)
+
+// withUmask runs fn with the process umask set so new files get at most
+// mode, so a socket is never reachable with looser permissions than
+// requested. The umask is process-wide; this runs during startup, before
+// other goroutines create files.
+func withUmask(mode os.FileMode, fn func() error) error {
+	old := syscall.Umask(int(^mode & os.ModePerm))
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package listener
+
+import "os"
+
+// withUmask runs fn; Windows has no umask
+func withUmask(_ os.FileMode, fn func() error) error {
+	return fn()
+}
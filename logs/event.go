@@ -12,6 +12,8 @@ type AccessEvent struct {
 	Outcome    string    `json:"outcome"`
 	Reason     string    `json:"reason"`
 	StatusCode int       `json:"status_code"`
+	// RequestID matches the ID shown to a denied client
+	RequestID string `json:"request_id,omitempty"`
 
 	// Device identifier
 	DeviceID string `json:"device_id"`
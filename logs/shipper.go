@@ -8,12 +8,14 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/utils"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logger"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
 	"github.com/getsentry/sentry-go"
 )
 
@@ -25,6 +27,9 @@ const (
 	maxBackoff              = 30 * time.Second
 	circuitBreakerThreshold = 10
 	circuitBreakerTimeout   = 60 * time.Second
+	// tokenMinValidity covers the request timeout, so the token cannot
+	// expire while a batch is in flight
+	tokenMinValidity = 1 * time.Minute
 )
 
 type LogShipper struct {
@@ -46,14 +51,30 @@ type LogShipper struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// stopMu guards eventChan against sends after it was closed
+	stopMu  sync.RWMutex
+	stopped bool
+
 	metrics *ShipperMetrics
 }
 
 type TokenProvider interface {
-	GetToken() string
+	GetTokenWithMinValidity(minValidity time.Duration) (string, error)
+	ForceRefresh() error
 	GetLogsURL() string
 }
 
+// sendError is returned for non-2xx responses from the logs endpoint
+type sendError struct {
+	statusCode int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *sendError) Error() string {
+	return "server error (status " + strconv.Itoa(e.statusCode) + "): " + e.message
+}
+
 type ShipperMetrics struct {
 	EventsShipped  atomic.Int64
 	EventsDropped  atomic.Int64
@@ -115,30 +136,57 @@ func (s *LogShipper) Start() {
 }
 
 func (s *LogShipper) Stop() error {
-	s.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// Shutdown stops accepting events, ships the pending batch and flushes the
+// buffer. In-flight requests are aborted once ctx is done. Events sent
+// after Shutdown are dropped.
+func (s *LogShipper) Shutdown(ctx context.Context) error {
+	s.stopMu.Lock()
+	if s.stopped {
+		s.stopMu.Unlock()
+		return nil
+	}
+	s.stopped = true
 	close(s.eventChan)
+	s.stopMu.Unlock()
 
 	done := make(chan struct{})
 	go func() {
 		s.wg.Wait()
+		s.flushBuffer()
 		close(done)
 	}()
 
+	// The shipper context stays alive until flushing is done, so the
+	// final requests are not cancelled
+	defer s.cancel()
+
 	select {
 	case <-done:
-		s.flushBuffer()
 		return nil
-	case <-time.After(10 * time.Second):
+	case <-ctx.Done():
 		return errors.New("timeout waiting for log shipper to stop")
 	}
 }
 
 func (s *LogShipper) SendEvent(event *AccessEvent) {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+
+	if s.stopped {
+		s.dropEvents(1, "shutdown")
+		return
+	}
+
 	select {
 	case s.eventChan <- event:
 	default:
 		if !s.buffer.Add(event) {
-			s.metrics.EventsDropped.Add(1)
+			s.dropEvents(1, "buffer_full")
 			logger.Warn("Event dropped: buffer full")
 		}
 	}
@@ -196,7 +244,7 @@ func (s *LogShipper) shipBatch(events []*AccessEvent) {
 	if s.isCircuitOpen() {
 		for _, event := range events {
 			if !s.buffer.Add(event) {
-				s.metrics.EventsDropped.Add(int64(1))
+				s.dropEvents(1, "buffer_full")
 			}
 		}
 		return
@@ -210,7 +258,7 @@ func (s *LogShipper) shipBatch(events []*AccessEvent) {
 	if !s.bucket.Allow(1) {
 		for _, event := range events {
 			if !s.buffer.Add(event) {
-				s.metrics.EventsDropped.Add(int64(1))
+				s.dropEvents(1, "buffer_full")
 			}
 		}
 		return
@@ -220,11 +268,23 @@ func (s *LogShipper) shipBatch(events []*AccessEvent) {
 	payload, err := s.eventsToJSONL(events)
 	if err != nil {
 		logger.Error("Failed to convert events to JSONL", "error", err)
-		s.metrics.EventsDropped.Add(int64(len(events)))
+		s.dropEvents(len(events), "encode_error")
 		return
 	}
 
 	err = s.sendWithRetry(payload)
+	if err != nil && !isRetryableError(err) {
+		// The endpoint rejected the batch itself; retrying it later would
+		// fail the same way, so it is dropped without opening the circuit
+		var sendErr *sendError
+		errors.As(err, &sendErr)
+		s.metrics.ShippingErrors.Add(1)
+		s.dropEvents(len(events), "http_"+strconv.Itoa(sendErr.statusCode))
+		logger.Error("Logs endpoint rejected batch, dropping events",
+			"events", len(events),
+			"error", err)
+		return
+	}
 	if err != nil {
 		s.recordFailure()
 		s.metrics.ShippingErrors.Add(1)
@@ -235,7 +295,7 @@ func (s *LogShipper) shipBatch(events []*AccessEvent) {
 
 		for _, event := range events {
 			if !s.buffer.Add(event) {
-				s.metrics.EventsDropped.Add(int64(1))
+				s.dropEvents(1, "buffer_full")
 			}
 		}
 	} else {
@@ -248,10 +308,28 @@ func (s *LogShipper) shipBatch(events []*AccessEvent) {
 func (s *LogShipper) sendWithRetry(payload []byte) error {
 	var lastErr error
 	backoff := initialBackoff
+	refreshed := false
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			time.Sleep(backoff)
+			delay := backoff
+			if wait := retryAfter(lastErr); wait > delay {
+				// Waiting longer than maxBackoff would stall the shipper;
+				// leave the batch to a later flush instead
+				if wait > maxBackoff {
+					return lastErr
+				}
+				delay = wait
+			}
+			// Shutdown cancels the context once its deadline passed, which
+			// leaves the batch to the buffer instead of waiting out the delay
+			timer := time.NewTimer(delay)
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return lastErr
+			case <-timer.C:
+			}
 			backoff = utils.MinDuration(backoff*2, maxBackoff)
 		}
 
@@ -260,6 +338,18 @@ func (s *LogShipper) sendWithRetry(payload []byte) error {
 			return nil
 		}
 
+		// A rejected token is refreshed and the batch resent once
+		if statusCode(err) == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			logger.Debug("Logs endpoint rejected access token, refreshing")
+			if refreshErr := s.tokenProvider.ForceRefresh(); refreshErr == nil {
+				err = s.send(payload)
+				if err == nil {
+					return nil
+				}
+			}
+		}
+
 		lastErr = err
 
 		if !isRetryableError(err) {
@@ -276,8 +366,11 @@ func (s *LogShipper) send(payload []byte) error {
 		return errors.New("logs URL not available")
 	}
 
-	token := s.tokenProvider.GetToken()
+	token, err := s.tokenProvider.GetTokenWithMinValidity(tokenMinValidity)
 	if token == "" {
+		if err != nil {
+			return errors.New("access token not available: " + err.Error())
+		}
 		return errors.New("access token not available")
 	}
 
@@ -321,7 +414,14 @@ func (s *LogShipper) send(payload []byte) error {
 	}
 
 	bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-	return errors.New("server error: " + string(bodyBytes))
+	sendErr := &sendError{
+		statusCode: resp.StatusCode,
+		message:    string(bodyBytes),
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		sendErr.retryAfter = utils.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return sendErr
 }
 
 func (s *LogShipper) isCircuitOpen() bool {
@@ -369,6 +469,23 @@ func (s *LogShipper) GetMetrics() *ShipperMetrics {
 	return s.metrics
 }
 
+// ShipperStatus is a snapshot of the shipper's delivery state
+type ShipperStatus struct {
+	CircuitOpen    bool
+	Buffered       int
+	BufferCapacity int
+	EventsDropped  int64
+}
+
+func (s *LogShipper) Status() ShipperStatus {
+	return ShipperStatus{
+		CircuitOpen:    s.circuitOpen.Load(),
+		Buffered:       s.buffer.Size(),
+		BufferCapacity: s.buffer.Capacity(),
+		EventsDropped:  s.metrics.EventsDropped.Load(),
+	}
+}
+
 func compressPayload(data []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	gz := gzip.NewWriter(&buf)
@@ -385,8 +502,38 @@ func compressPayload(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func isRetryableError(_ error) bool {
-	return true
+// isRetryableError reports whether a failed send may succeed when
+// repeated. Client errors other than 408 and 429 are final.
+func isRetryableError(err error) bool {
+	code := statusCode(err)
+	if code < 400 || code >= 500 {
+		return true
+	}
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// statusCode returns the HTTP status of a failed send, or 0 if no response
+// was received
+func statusCode(err error) int {
+	var sendErr *sendError
+	if errors.As(err, &sendErr) {
+		return sendErr.statusCode
+	}
+	return 0
+}
+
+func retryAfter(err error) time.Duration {
+	var sendErr *sendError
+	if errors.As(err, &sendErr) {
+		return sendErr.retryAfter
+	}
+	return 0
+}
+
+// dropEvents records n dropped events under reason
+func (s *LogShipper) dropEvents(n int, reason string) {
+	s.metrics.EventsDropped.Add(int64(n))
+	metrics.LogEventsDroppedByReasonTotal.WithLabelValues(reason).Add(float64(n))
 }
 
 // Convert events to JSONL format (newline-delimited JSON)
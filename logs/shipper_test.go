@@ -0,0 +1,173 @@
+package logs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTokens hands out "old" until it is refreshed, then "new"
+type testTokens struct {
+	mu        sync.Mutex
+	token     string
+	refreshes int
+	logsURL   string
+}
+
+func (p *testTokens) GetTokenWithMinValidity(time.Duration) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.token, nil
+}
+
+func (p *testTokens) ForceRefresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshes++
+	p.token = "new"
+	return nil
+}
+
+func (p *testTokens) GetLogsURL() string {
+	return p.logsURL
+}
+
+// newTestShipper returns a shipper posting to a server answering with
+// handler, and a counter of the requests it received
+func newTestShipper(t *testing.T, handler http.HandlerFunc) (*LogShipper, *testTokens, func() int) {
+	t.Helper()
+
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	tokens := &testTokens{token: "old", logsURL: ts.URL}
+	shipper := NewLogShipper(tokens, &LogShipperConfig{})
+	t.Cleanup(shipper.cancel)
+
+	return shipper, tokens, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func testEvents(n int) []*AccessEvent {
+	events := make([]*AccessEvent, n)
+	for i := range events {
+		events[i] = &AccessEvent{EventType: "access", Outcome: "deny"}
+	}
+	return events
+}
+
+func TestShipperRefreshesRejectedToken(t *testing.T) {
+	shipper, tokens, requests := newTestShipper(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	shipper.shipBatch(testEvents(3))
+
+	if got := requests(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+	if tokens.refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", tokens.refreshes)
+	}
+	if got := shipper.metrics.EventsShipped.Load(); got != 3 {
+		t.Errorf("events shipped = %d, want 3", got)
+	}
+}
+
+func TestShipperRefreshesOnlyOnce(t *testing.T) {
+	shipper, tokens, requests := newTestShipper(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	if err := shipper.sendWithRetry([]byte("{}\n")); err == nil {
+		t.Fatal("send succeeded")
+	}
+	// 401 is final after the refreshed token was rejected as well
+	if got := requests(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+	if tokens.refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", tokens.refreshes)
+	}
+}
+
+func TestShipperDropsRejectedBatch(t *testing.T) {
+	shipper, _, requests := newTestShipper(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+	})
+
+	shipper.shipBatch(testEvents(3))
+
+	if got := requests(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+	if got := shipper.metrics.EventsDropped.Load(); got != 3 {
+		t.Errorf("events dropped = %d, want 3", got)
+	}
+	if size := shipper.buffer.Size(); size != 0 {
+		t.Errorf("buffered events = %d, want 0", size)
+	}
+	// A rejected batch says nothing about the endpoint's health
+	if failures := shipper.failureCount.Load(); failures != 0 {
+		t.Errorf("failure count = %d, want 0", failures)
+	}
+}
+
+func TestShipperDoesNotWaitOutLongRetryAfter(t *testing.T) {
+	shipper, _, requests := newTestShipper(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	start := time.Now()
+	shipper.shipBatch(testEvents(3))
+
+	if elapsed := time.Since(start); elapsed > maxBackoff {
+		t.Errorf("shipBatch blocked for %v", elapsed)
+	}
+	if got := requests(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+	// The batch is kept for a later flush
+	if size := shipper.buffer.Size(); size != 3 {
+		t.Errorf("buffered events = %d, want 3", size)
+	}
+	if got := shipper.metrics.EventsDropped.Load(); got != 0 {
+		t.Errorf("events dropped = %d, want 0", got)
+	}
+}
+
+func TestShipperRetryStopsOnCancel(t *testing.T) {
+	shipper, _, requests := newTestShipper(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	time.AfterFunc(100*time.Millisecond, shipper.cancel)
+
+	start := time.Now()
+	if err := shipper.sendWithRetry([]byte("{}\n")); err == nil {
+		t.Fatal("send succeeded")
+	}
+	if elapsed := time.Since(start); elapsed >= initialBackoff {
+		t.Errorf("retry waited %v after cancel", elapsed)
+	}
+	if got := requests(); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/api"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/auth"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/edl"
@@ -18,6 +21,7 @@ import (
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/logs"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/metrics"
 	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/listener"
 	"github.com/getsentry/sentry-go"
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -55,6 +59,9 @@ func main() {
 	}
 	defer sentry.Flush(2 * time.Second)
 
+	// Report the build version to the platform during bootstrap
+	api.SetComponentVersion(Version)
+
 	cfg, err := config.Load()
 	if err != nil {
 		sentry.CaptureException(err)
@@ -80,14 +87,20 @@ func main() {
 	// Initialize core components
 	matcher := ipmatcher.New()
 	updater := initEDL(ctx, cfg, matcher)
-	authHandler := initAuthHandler(cfg, matcher, updater)
+	authHandler := initAuthHandler(ctx, cfg, matcher, updater)
+	watcher := initConfigWatcher(ctx, cfg, updater, authHandler.Handler)
+	cfg.WatchBootstrapFile(ctx)
+	healthHandler := initHealthHandler(cfg, updater, authHandler, watcher)
 
 	// Start servers
-	server := startMainServer(cfg, authHandler, auth.NewHealthHandler(updater))
-	metricsServer := startMetricsServer(cfg)
+	server := startMainServer(ctx, cfg, authHandler, healthHandler)
+	metricsServer := startMetricsServer(ctx, cfg, updater, healthHandler)
+
+	// Let a parent process that handed over its sockets start draining
+	listener.NotifyReady()
 
 	// Handle shutdown
-	waitForShutdown(ctx, cancel, server, metricsServer, authHandler.logShipper, authHandler.metricsCollector)
+	waitForShutdown(ctx, cancel, cfg, healthHandler, server, metricsServer, authHandler.logShipper, authHandler.metricsCollector)
 }
 
 func logConfig(cfg *config.Config) {
@@ -110,11 +123,13 @@ func initEDL(ctx context.Context, cfg *config.Config, matcher *ipmatcher.Matcher
 
 	if cfg.DeploymentEnabled {
 		logger.Debug("Fetching initial EDL...")
-		if err := updater.Start(ctx); err != nil {
-			logger.Error("Failed to start EDL updater", "error", err)
-			os.Exit(1)
-		}
+	}
+	if err := updater.Start(ctx); err != nil {
+		logger.Error("Failed to start EDL updater", "error", err)
+		os.Exit(1)
+	}
 
+	if cfg.DeploymentEnabled {
 		// Initialize EDL metrics
 		lastUpdate, _, updateCount, entryCount := updater.GetStatus()
 		metrics.EDLEntries.Set(float64(entryCount))
@@ -131,14 +146,74 @@ func initEDL(ctx context.Context, cfg *config.Config, matcher *ipmatcher.Matcher
 	return updater
 }
 
+// initConfigWatcher polls the platform for EDL configuration changes and
+// applies them to the updater and auth handler
+func initConfigWatcher(ctx context.Context, cfg *config.Config, updater *edl.Updater, handler *auth.Handler) *config.Watcher {
+	watcher := config.NewWatcher(cfg)
+
+	watcher.OnChange(func(ctx context.Context, old, new config.EDLSettings) error {
+		// The updater publishes the new list together with its mode, so
+		// decisions are never made with one policy's mode against another
+		// policy's list. If it cannot be loaded, the old mode and list stay
+		// in effect and the watcher retries the change on its next poll.
+		if err := updater.Reconfigure(ctx, old, new); err != nil {
+			return err
+		}
+
+		// A disabled deployment keeps its list for last-known-good
+		// decisions, so the entry count metric keeps reporting it
+		handler.SetMode(new.Mode)
+		return nil
+	})
+
+	watcher.OnStateChange(func(old, new config.DeploymentState) {
+		handler.SetDeploymentState(new)
+	})
+
+	watcher.Start(ctx)
+	return watcher
+}
+
+func initHealthHandler(cfg *config.Config, updater *edl.Updater, authHandler *AuthHandlerWithDeps, watcher *config.Watcher) *auth.HealthHandler {
+	healthHandler := auth.NewHealthHandler(updater, authHandler.Handler)
+	healthHandler.SetTokenManager(cfg.TokenManager)
+	healthHandler.SetConfigWatcher(watcher)
+	if authHandler.logShipper != nil {
+		healthHandler.SetLogShipper(authHandler.logShipper)
+	}
+	return healthHandler
+}
+
 type AuthHandlerWithDeps struct {
 	*auth.Handler
 	logShipper       *logs.LogShipper
 	metricsCollector *logs.MetricsCollector
 }
 
-func initAuthHandler(cfg *config.Config, matcher *ipmatcher.Matcher, updater *edl.Updater) *AuthHandlerWithDeps {
-	handler := auth.NewHandler(matcher, cfg.EDLMode, cfg.DeploymentEnabled)
+func initAuthHandler(ctx context.Context, cfg *config.Config, matcher *ipmatcher.Matcher, updater *edl.Updater) *AuthHandlerWithDeps {
+	handler := auth.NewHandler(matcher, cfg.EDLMode, cfg.GetDeploymentState())
+	handler.SetUpdater(updater)
+	handler.SetPolicies(cfg.Policies)
+
+	if cfg.AuthSecret != "" {
+		handler.SetCallerAuth(auth.NewCallerAuth(cfg.AuthSecretHeader, cfg.AuthSecret, cfg.AuthSecretMode == "hmac"))
+		logger.Debug("Caller authentication enabled", "header", cfg.AuthSecretHeader, "mode", cfg.AuthSecretMode)
+	}
+
+	// The block page is watched even when it cannot be loaded yet, so one
+	// added later is picked up without a restart
+	blockPage := auth.NewBlockPage(cfg.BlockPageDir, cfg.SupportContact)
+	if err := blockPage.Load(); err != nil {
+		logger.Warn("Block page unavailable, denied requests get a plain response until it loads", "error", err)
+	}
+	handler.SetBlockPage(blockPage)
+	blockPage.Watch(ctx, cfg.BlockPageReloadInterval)
+
+	if cfg.DenyRedirectSecret != "" {
+		handler.SetRedirectSecret([]byte(cfg.DenyRedirectSecret))
+	} else if cfg.Policies.RedirectsDenials() {
+		logger.Warn("Denial redirects carry no reason token, set DENY_REDIRECT_SECRET to sign one")
+	}
 
 	if cfg.IPHeaderOverride != "" {
 		handler.SetIPHeaderOverride(cfg.IPHeaderOverride)
@@ -147,9 +222,14 @@ func initAuthHandler(cfg *config.Config, matcher *ipmatcher.Matcher, updater *ed
 
 	result := &AuthHandlerWithDeps{Handler: handler}
 
-	// Initialize log shipping if configured
-	if cfg.TokenManager.GetLogsURL() != "" {
+	// Initialize log shipping if configured and permitted
+	switch {
+	case !cfg.LogShippingEnabled:
+		logger.Debug("Log shipping disabled")
+	case cfg.TokenManager.GetLogsURL() != "":
 		result.logShipper, result.metricsCollector = initLogShipping(cfg, handler)
+	case cfg.TokenManager.GetToken() != "" && !cfg.TokenManager.HasScope(api.ScopeLogs):
+		logger.Info("Log shipping disabled - edl_logs scope not granted")
 	}
 
 	return result
@@ -182,7 +262,7 @@ func initLogShipping(cfg *config.Config, handler *auth.Handler) (*logs.LogShippe
 	return logShipper, metricsCollector
 }
 
-func startMainServer(cfg *config.Config, authHandler *AuthHandlerWithDeps, healthHandler *auth.HealthHandler) *http.Server {
+func startMainServer(ctx context.Context, cfg *config.Config, authHandler *AuthHandlerWithDeps, healthHandler *auth.HealthHandler) *http.Server {
 	// Create Sentry handler
 	sentryHandler := sentryhttp.New(sentryhttp.Options{
 		Repanic: true,
@@ -199,9 +279,12 @@ func startMainServer(cfg *config.Config, authHandler *AuthHandlerWithDeps, healt
 	mux.Handle("/", sentryHandler.Handle(authHandler.Handler))
 	mux.HandleFunc("/health", healthHandler.Health)
 	mux.HandleFunc("/ready", healthHandler.Ready)
+	if !cfg.ProbesOnMetricsPort {
+		registerProbes(mux, healthHandler)
+	}
 
 	server := &http.Server{
-		Addr:              ":" + cfg.Port,
+		Addr:              cfg.ListenAddr(),
 		Handler:           mux,
 		ReadTimeout:       5 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
@@ -209,9 +292,22 @@ func startMainServer(cfg *config.Config, authHandler *AuthHandlerWithDeps, healt
 		IdleTimeout:       30 * time.Second,
 	}
 
+	l, err := listener.Listen("auth", server.Addr, cfg.SocketMode)
+	if err == nil {
+		l, err = withTLS(ctx, cfg, l, listener.TLSFiles{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			ClientCAFile: cfg.TLSClientCAFile,
+		})
+	}
+	if err != nil {
+		logger.Error("Failed to listen", "address", server.Addr, "error", err)
+		os.Exit(1)
+	}
+
 	go func() {
-		logger.Info("Starting auth server", "port", cfg.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("Starting auth server", "address", server.Addr)
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
 			logger.Error("Server error", "error", err)
 			os.Exit(1)
 		}
@@ -220,33 +316,89 @@ func startMainServer(cfg *config.Config, authHandler *AuthHandlerWithDeps, healt
 	return server
 }
 
-func startMetricsServer(cfg *config.Config) *http.Server {
+// withTLS serves l over TLS when certificate files are configured,
+// reloading them as they change
+func withTLS(ctx context.Context, cfg *config.Config, l net.Listener, files listener.TLSFiles) (net.Listener, error) {
+	if !files.Enabled() {
+		return l, nil
+	}
+
+	reloader, err := listener.NewTLSReloader(files)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	reloader.Watch(ctx, cfg.TLSReloadInterval)
+
+	return reloader.Listener(l), nil
+}
+
+// registerProbes mounts the Kubernetes-style probe endpoints
+func registerProbes(mux *http.ServeMux, healthHandler *auth.HealthHandler) {
+	mux.HandleFunc("/livez", healthHandler.Livez)
+	mux.HandleFunc("/readyz", healthHandler.Readyz)
+	mux.HandleFunc("/startupz", healthHandler.Startupz)
+}
+
+func startMetricsServer(ctx context.Context, cfg *config.Config, updater *edl.Updater, healthHandler *auth.HealthHandler) *http.Server {
+	adminAuth := auth.NewAdminAuth(cfg.MetricsAuthUsername, cfg.MetricsAuthPassword, cfg.MetricsAuthToken)
+
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-
-	// Add pprof endpoints for profiling
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	mux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
-	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
+	mux.Handle("/metrics", adminAuth.Wrap(promhttp.Handler()))
+
+	if cfg.ProbesOnMetricsPort {
+		registerProbes(mux, healthHandler)
+	}
 
+	// Inbound push notifications for new EDL versions
+	if cfg.EDLWebhookSecret != "" {
+		mux.Handle("/webhooks/edl", edl.NewWebhookHandler(updater, cfg.EDLWebhookSecret))
+		logger.Debug("EDL webhook enabled", "path", "/webhooks/edl")
+	}
+
+	// Add pprof endpoints for profiling; they expose the command line and
+	// can be used to load the process, so they are opt-in
+	if cfg.PprofEnabled {
+		mux.Handle("/debug/pprof/", adminAuth.Wrap(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", adminAuth.Wrap(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", adminAuth.Wrap(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", adminAuth.Wrap(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", adminAuth.Wrap(http.HandlerFunc(pprof.Trace)))
+		mux.Handle("/debug/pprof/heap", adminAuth.Wrap(pprof.Handler("heap")))
+		mux.Handle("/debug/pprof/goroutine", adminAuth.Wrap(pprof.Handler("goroutine")))
+		mux.Handle("/debug/pprof/threadcreate", adminAuth.Wrap(pprof.Handler("threadcreate")))
+		mux.Handle("/debug/pprof/block", adminAuth.Wrap(pprof.Handler("block")))
+		if !adminAuth.Enabled() {
+			logger.Warn("pprof endpoints are enabled without authentication")
+		}
+	}
+
+	// The write deadline is set per request instead of with WriteTimeout,
+	// which pprof also uses to reject profiles longer than it
 	server := &http.Server{
-		Addr:              ":" + cfg.MetricsPort,
-		Handler:           mux,
+		Addr:              cfg.MetricsListenAddr(),
+		Handler:           withWriteDeadline(mux),
 		ReadTimeout:       5 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       30 * time.Second,
 	}
 
+	l, err := listener.Listen("metrics", server.Addr, cfg.SocketMode)
+	if err == nil {
+		l, err = withTLS(ctx, cfg, l, listener.TLSFiles{
+			CertFile:     cfg.MetricsTLSCertFile,
+			KeyFile:      cfg.MetricsTLSKeyFile,
+			ClientCAFile: cfg.MetricsTLSClientCAFile,
+		})
+	}
+	if err != nil {
+		logger.Error("Failed to listen for metrics", "address", server.Addr, "error", err)
+		os.Exit(1)
+	}
+
 	go func() {
-		logger.Info("Starting metrics server", "port", cfg.MetricsPort)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("Starting metrics server", "address", server.Addr)
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
 			logger.Error("Metrics server error", "error", err)
 		}
 	}()
@@ -254,37 +406,158 @@ func startMetricsServer(cfg *config.Config) *http.Server {
 	return server
 }
 
-func waitForShutdown(ctx context.Context, cancel context.CancelFunc, server, metricsServer *http.Server, logShipper *logs.LogShipper, metricsCollector *logs.MetricsCollector) {
+const (
+	metricsWriteTimeout = 10 * time.Second
+	// maxProfileDuration bounds the seconds parameter of the pprof profile
+	// and trace endpoints
+	maxProfileDuration = 5 * time.Minute
+)
+
+// withWriteDeadline gives each metrics request metricsWriteTimeout to
+// write its response. The pprof profile and trace endpoints stream for the
+// requested number of seconds, so they get that much longer, up to
+// maxProfileDuration.
+func withWriteDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := metricsWriteTimeout
+
+		switch r.URL.Path {
+		case "/debug/pprof/profile", "/debug/pprof/trace":
+			duration := 30 * time.Second
+			if r.URL.Path == "/debug/pprof/trace" {
+				duration = time.Second
+			}
+			if value := r.URL.Query().Get("seconds"); value != "" {
+				seconds, err := strconv.ParseFloat(value, 64)
+				if err != nil || seconds <= 0 {
+					http.Error(w, "invalid seconds parameter", http.StatusBadRequest)
+					return
+				}
+				duration = time.Duration(seconds * float64(time.Second))
+			}
+			if duration > maxProfileDuration {
+				http.Error(w, "seconds exceeds the "+maxProfileDuration.String()+" limit", http.StatusBadRequest)
+				return
+			}
+			timeout += duration
+		}
+
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			logger.Debug("Failed to set write deadline", "path", r.URL.Path, "error", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func waitForShutdown(ctx context.Context, cancel context.CancelFunc, cfg *config.Config, healthHandler *auth.HealthHandler, server, metricsServer *http.Server, logShipper *logs.LogShipper, metricsCollector *logs.MetricsCollector) {
+	signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if listener.HandoffSignal != nil {
+		signals = append(signals, listener.HandoffSignal)
+	}
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, signals...)
 
-	logger.Info("Shutting down servers...")
+	handedOff := false
+	for !handedOff {
+		sig := <-sigChan
+		if listener.HandoffSignal == nil || sig != listener.HandoffSignal {
+			break
+		}
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
+		// Start a new process on the same sockets and only shut down once
+		// it is serving
+		logger.Info("Handing over sockets to a new process")
+		handoffCtx, handoffCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		err := listener.Reexec(handoffCtx)
+		handoffCancel()
+		if err != nil {
+			logger.Error("Socket handoff failed, continuing to serve", "error", err)
+			continue
+		}
+		handedOff = true
+	}
+
+	logger.Info("Shutting down servers...",
+		"drain_period", cfg.ShutdownDrainPeriod,
+		"timeout", cfg.ShutdownTimeout)
 
-	// Stop log shipper and flush remaining events
+	seq := shutdownSequence{
+		drainPeriod:   cfg.ShutdownDrainPeriod,
+		timeout:       cfg.ShutdownTimeout,
+		healthHandler: healthHandler,
+		server:        server,
+		metricsServer: metricsServer,
+	}
 	if logShipper != nil {
+		seq.logShipper = logShipper
+	}
+	if metricsCollector != nil {
+		seq.stopCollector = metricsCollector.Stop
+	}
+	seq.run(handedOff)
+
+	cancel()
+	logger.Info("Server stopped")
+}
+
+// shutdowner is implemented by the servers and the log shipper
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdownSequence stops the process in an order that loses neither
+// in-flight decisions nor the log events they produce
+type shutdownSequence struct {
+	drainPeriod   time.Duration
+	timeout       time.Duration
+	healthHandler *auth.HealthHandler
+	server        shutdowner
+	logShipper    shutdowner
+	stopCollector func()
+	metricsServer shutdowner
+}
+
+func (s shutdownSequence) run(handedOff bool) {
+	// Everything below shares one deadline
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), s.timeout)
+	defer shutdownCancel()
+
+	// 1. Fail readiness so Traefik and Kubernetes stop sending new requests.
+	// After a handoff the new process serves on the same sockets, so
+	// readiness stays up and no drain is needed.
+	if !handedOff {
+		s.healthHandler.SetShuttingDown()
+	}
+
+	// 2. Keep serving while the readiness change propagates
+	if !handedOff && s.drainPeriod > 0 {
+		logger.Debug("Draining connections", "period", s.drainPeriod)
+		select {
+		case <-time.After(s.drainPeriod):
+		case <-shutdownCtx.Done():
+		}
+	}
+
+	// 3. Stop the auth server, waiting for in-flight decisions
+	if err := s.server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Server shutdown error", "error", err)
+	}
+
+	// 4. Flush log events once no more decisions can produce them
+	if s.logShipper != nil {
 		logger.Debug("Flushing log events...")
-		if err := logShipper.Stop(); err != nil {
+		if err := s.logShipper.Shutdown(shutdownCtx); err != nil {
 			logger.Error("Error stopping log shipper", "error", err)
 		}
 	}
 
 	// Stop metrics collector
-	if metricsCollector != nil {
-		metricsCollector.Stop()
+	if s.stopCollector != nil {
+		s.stopCollector()
 	}
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		logger.Error("Server shutdown error", "error", err)
-	}
-
-	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+	// 5. The metrics server goes last, so it can be scraped while draining
+	if err := s.metricsServer.Shutdown(shutdownCtx); err != nil {
 		logger.Error("Metrics server shutdown error", "error", err)
 	}
-
-	cancel()
-	logger.Info("Server stopped")
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/auth"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/config"
+	"github.com/ELLIO-Technology/ellio_traefik_forward_auth/ipmatcher"
+)
+
+// shutdownRecorder records the order and time of shutdown steps
+type shutdownRecorder struct {
+	mu    sync.Mutex
+	steps []string
+	times map[string]time.Time
+}
+
+func (r *shutdownRecorder) record(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+	if r.times == nil {
+		r.times = map[string]time.Time{}
+	}
+	r.times[step] = time.Now()
+}
+
+type fakeShutdowner struct {
+	name     string
+	recorder *shutdownRecorder
+	before   func()
+}
+
+func (f *fakeShutdowner) Shutdown(ctx context.Context) error {
+	if f.before != nil {
+		f.before()
+	}
+	f.recorder.record(f.name)
+	return nil
+}
+
+func readyStatus(hh *auth.HealthHandler) int {
+	w := httptest.NewRecorder()
+	hh.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return w.Code
+}
+
+func newShutdownTest(t *testing.T, drain time.Duration) (shutdownSequence, *shutdownRecorder, *auth.HealthHandler) {
+	t.Helper()
+
+	handler := auth.NewHandler(ipmatcher.New(), "blocklist", config.DeploymentActive)
+	hh := auth.NewHealthHandler(nil, handler)
+	if code := readyStatus(hh); code != http.StatusOK {
+		t.Fatalf("readiness before shutdown = %d, want 200", code)
+	}
+
+	rec := &shutdownRecorder{}
+	seq := shutdownSequence{
+		drainPeriod:   drain,
+		timeout:       5 * time.Second,
+		healthHandler: hh,
+		server: &fakeShutdowner{name: "server", recorder: rec, before: func() {
+			if code := readyStatus(hh); code != http.StatusServiceUnavailable {
+				t.Errorf("readiness during server shutdown = %d, want 503", code)
+			}
+		}},
+		logShipper:    &fakeShutdowner{name: "log_shipper", recorder: rec},
+		stopCollector: func() { rec.record("metrics_collector") },
+		metricsServer: &fakeShutdowner{name: "metrics_server", recorder: rec},
+	}
+	return seq, rec, hh
+}
+
+func TestShutdownOrder(t *testing.T) {
+	const drain = 100 * time.Millisecond
+	seq, rec, hh := newShutdownTest(t, drain)
+
+	start := time.Now()
+	seq.run(false)
+
+	want := []string{"server", "log_shipper", "metrics_collector", "metrics_server"}
+	if len(rec.steps) != len(want) {
+		t.Fatalf("steps = %v, want %v", rec.steps, want)
+	}
+	for i := range want {
+		if rec.steps[i] != want[i] {
+			t.Fatalf("steps = %v, want %v", rec.steps, want)
+		}
+	}
+
+	// The server only stops once the drain period has passed
+	if waited := rec.times["server"].Sub(start); waited < drain {
+		t.Errorf("server shut down after %v, before the %v drain period", waited, drain)
+	}
+	if code := readyStatus(hh); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness after shutdown = %d, want 503", code)
+	}
+}
+
+func TestShutdownAfterHandoffSkipsDrain(t *testing.T) {
+	seq, rec, hh := newShutdownTest(t, time.Hour)
+	// After a handoff readiness stays up for the new process
+	seq.server.(*fakeShutdowner).before = nil
+
+	done := make(chan struct{})
+	go func() {
+		seq.run(true)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown after handoff waited for the drain period")
+	}
+
+	if code := readyStatus(hh); code != http.StatusOK {
+		t.Errorf("readiness after handoff = %d, want 200", code)
+	}
+	if len(rec.steps) != 4 || rec.steps[0] != "server" || rec.steps[1] != "log_shipper" {
+		t.Errorf("steps = %v", rec.steps)
+	}
+}
+
+func TestShutdownDrainBoundedByTimeout(t *testing.T) {
+	seq, rec, _ := newShutdownTest(t, time.Hour)
+	seq.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	seq.run(false)
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v despite a %v timeout", elapsed, seq.timeout)
+	}
+	if len(rec.steps) != 4 {
+		t.Errorf("steps = %v, want all four to run", rec.steps)
+	}
+}
+
+func TestProfileLongerThanWriteTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	server := httptest.NewUnstartedServer(withWriteDeadline(mux))
+	server.Config.ReadHeaderTimeout = 5 * time.Second
+	server.Start()
+	defer server.Close()
+
+	// Like the metrics server, this server has no WriteTimeout, which pprof
+	// would use to reject the profile; the deadline comes from the wrapper
+	resp, err := http.Get(server.URL + "/debug/pprof/profile?seconds=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("profile status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp, err = http.Get(server.URL + "/debug/pprof/profile?seconds=3600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("over-limit profile status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -23,6 +23,22 @@ var (
 		[]string{"result"},
 	)
 
+	CallerAuthFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_caller_auth_failures_total",
+			Help: "Total number of auth requests rejected for a missing or invalid shared secret",
+		},
+		[]string{"reason"},
+	)
+
+	FailModeDecisionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_fail_mode_decisions_total",
+			Help: "Total number of auth decisions made by a fail mode instead of normal EDL evaluation",
+		},
+		[]string{"fail_mode", "cause"},
+	)
+
 	// EDL metrics
 	EDLEntries = promauto.NewGauge(
 		prometheus.GaugeOpts{
@@ -46,6 +62,27 @@ var (
 		},
 	)
 
+	EDLAgeSeconds = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "forwardauth_edl_age_seconds",
+			Help: "Age of the loaded EDL in seconds",
+		},
+	)
+
+	EDLStale = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "forwardauth_edl_stale",
+			Help: "Whether the loaded EDL exceeds its max age (1) or not (0)",
+		},
+	)
+
+	EDLNextUpdateTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "forwardauth_edl_next_update_timestamp",
+			Help: "Unix timestamp of the next scheduled EDL update",
+		},
+	)
+
 	EDLUpdateDuration = promauto.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "forwardauth_edl_update_duration_seconds",
@@ -54,6 +91,95 @@ var (
 		},
 	)
 
+	EDLDeltaUpdatesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_edl_delta_updates_total",
+			Help: "Total number of EDL delta update attempts",
+		},
+		[]string{"status"},
+	)
+
+	EDLPushNotificationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_edl_push_notifications_total",
+			Help: "Total number of push notifications announcing a new EDL version",
+		},
+		[]string{"source"},
+	)
+
+	EDLDownloadBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_edl_download_bytes_total",
+			Help: "Total EDL bytes transferred over the wire and parsed after decompression",
+		},
+		[]string{"stage"},
+	)
+
+	// Config metrics
+	ConfigVersion = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "forwardauth_config_version",
+			Help: "Local version of the EDL configuration, incremented on each applied change",
+		},
+	)
+
+	ConfigPollsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_config_polls_total",
+			Help: "Total number of EDL configuration polls",
+		},
+		[]string{"status"},
+	)
+
+	// Deployment state metrics
+	DeploymentState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "forwardauth_deployment_state",
+			Help: "Current deployment state (1 for the active state, 0 otherwise)",
+		},
+		[]string{"state"},
+	)
+
+	DeploymentStateTransitionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_deployment_state_transitions_total",
+			Help: "Total number of deployment state transitions",
+		},
+		[]string{"from", "to"},
+	)
+
+	// Token metrics
+	TokenVerificationFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_token_verification_failures_total",
+			Help: "Total number of platform tokens rejected by signature, issuer or expiry checks",
+		},
+		[]string{"token"},
+	)
+
+	TokenRefreshesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_token_refreshes_total",
+			Help: "Total number of access token refreshes by outcome (success, failure, revoked, deleted)",
+		},
+		[]string{"status"},
+	)
+
+	TokenRefreshDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "forwardauth_token_refresh_duration_seconds",
+			Help:    "Access token refresh duration in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	TokenRevoked = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "forwardauth_token_revoked",
+			Help: "Whether the platform rejected the bootstrap token as revoked (1 = revoked, 0 = ok)",
+		},
+	)
+
 	// Log shipping metrics
 	LogEventsShippedTotal = promauto.NewCounter(
 		prometheus.CounterOpts{
@@ -69,6 +195,14 @@ var (
 		},
 	)
 
+	LogEventsDroppedByReasonTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forwardauth_log_events_dropped_by_reason_total",
+			Help: "Total number of log events dropped, by reason (buffer_full, encode_error, shutdown, http_<status>)",
+		},
+		[]string{"reason"},
+	)
+
 	LogShippingErrorsTotal = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "forwardauth_log_shipping_errors_total",
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Jitter returns d randomly spread by up to ±fraction of its value
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if d <= 0 || fraction <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	spread := float64(d) * fraction
+	return time.Duration(float64(d) - spread + rand.Float64()*2*spread)
+}
+
+// Backoff returns base doubled for every attempt after the first, capped at max
+func Backoff(base, max time.Duration, attempt int) time.Duration {
+	if attempt <= 0 || base <= 0 {
+		return MinDuration(base, max)
+	}
+
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	return MinDuration(delay, max)
+}
@@ -46,6 +46,17 @@ func GetEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+func GetEnvAsFloat(key string, defaultValue float64) float64 {
+	strVal := GetEnv(key, "")
+	if strVal == "" {
+		return defaultValue
+	}
+	if floatVal, err := strconv.ParseFloat(strVal, 64); err == nil {
+		return floatVal
+	}
+	return defaultValue
+}
+
 func GetEnvAsBool(key string, defaultValue bool) bool {
 	strVal := GetEnv(key, "")
 	if strVal == "" {